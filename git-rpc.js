@@ -0,0 +1,76 @@
+// node process which performs git utility function logic for a pad server over
+// its stdin and stdout rather than HTTP. each line in is a JSON-RPC 2.0 request
+// and each line out is the response to one, tagged with the request's id, so a
+// pad server can have many requests in flight at once. exits when stdin closes.
+
+// require necessary git logic
+var git = require('./js/git');
+
+var methods = {
+  "ping": pingHandler,
+  "getDiff": getDiffHandler,
+  "rebase": rebaseHandler,
+  "applyDiff": applyDiffHandler,
+};
+
+// JSON-RPC 2.0 error codes
+var PARSE_ERROR = -32700;
+var METHOD_NOT_FOUND = -32601;
+var INVALID_PARAMS = -32602;
+
+var rl = require('readline').createInterface({
+  input: process.stdin,
+  terminal: false,
+});
+
+rl.on("line", function(line) {
+  if (line.trim() == "") {
+    return;
+  }
+  var req;
+  try {
+    req = JSON.parse(line);
+  } catch (er) {
+    return reply({id: null, error: {code: PARSE_ERROR, message: er.message}});
+  }
+  var method = methods[req.method];
+  if (method === undefined) {
+    return reply({id: req.id, error: {code: METHOD_NOT_FOUND,
+                                      message: "no method " + req.method}});
+  }
+  try {
+    reply({id: req.id, result: method(req.params)});
+  } catch (er) {
+    // the params did not make sense to the git logic
+    reply({id: req.id, error: {code: INVALID_PARAMS, message: er.message}});
+  }
+});
+
+rl.on("close", function() {
+  process.exit(0);
+});
+
+// JSON.stringify escapes newlines, so each response is exactly one line
+function reply(res) {
+  res.jsonrpc = "2.0";
+  process.stdout.write(JSON.stringify(res) + "\n");
+}
+
+function pingHandler(params) {
+  return "pong";
+}
+
+function getDiffHandler(params) {
+  return git.getDiff(params.a, params.b);
+}
+
+function rebaseHandler(params) {
+  var newDiff = git.rebase(params.c1.diff, params.c2.diff);
+  params.c2.diff = newDiff;
+  params.c2.parent += 1;
+  return params.c2;
+}
+
+function applyDiffHandler(params) {
+  return git.applyDiff(params.text, params.commit.diff);
+}
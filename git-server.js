@@ -1,5 +1,7 @@
 // node server which provides endpoints to perform git utility function logic
-// for a client. basically, git RPC. runs on port provided as an argument.
+// for a client. basically, git RPC. runs on port provided as an argument. when
+// a pad server launches it, it also passes "supervised" and holds its stdin
+// open, so it exits along with the pad server.
 
 // require necessary git logic
 var git = require('./js/git');
@@ -9,6 +11,12 @@ var port = parseInt(process.argv[2]);
 if (isNaN(port)) {
   throw "Invalid port";
 }
+if (process.argv[3] == "supervised") {
+  process.stdin.on("end", function() {
+    process.exit(0);
+  });
+  process.stdin.resume();
+}
 require('http').createServer(function(req, res) {
 
   // aggregate incoming data
@@ -26,6 +34,7 @@ require('http').createServer(function(req, res) {
         "/getDiff": getDiffHandler,
         "/rebase": rebaseHandler,
         "/applyDiff": applyDiffHandler,
+        "/health": healthHandler,
       }[path](data));
       res.end(reply);
     } catch (er) {
@@ -50,3 +59,7 @@ function rebaseHandler(data) {
 function applyDiffHandler(data) {
   return git.applyDiff(data.text, data.commit.diff);
 }
+
+function healthHandler(data) {
+  return "ok";
+}
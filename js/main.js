@@ -24,6 +24,13 @@ window.addEventListener("load", function() {
       textArea.setSelectionRange(selStart, selEnd);
     },
     docID: document.location.pathname,
+    // e.g. /docs/config?mode=lines creates a doc which merges whole lines
+    mergeMode: (document.location.search.match(/[?&]mode=(\w+)/) || [])[1],
+  });
+
+  // keep the address bar on the document's current name if it is renamed
+  document.addEventListener("pad:renamed", function(evt) {
+    history.replaceState(null, "", evt.detail + document.location.search);
   });
 
   // each time the client types, attempt to propagate it to other users. if
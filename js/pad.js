@@ -3,6 +3,7 @@ function Pad(params) {
 
   // store given parameters as attributes of this pad client object
   this.docID = params.docID
+  this.mergeMode = params.mergeMode // optional; "lines" merges whole lines
   this.getState = params.getState
   this.setState = params.setState
 
@@ -20,6 +21,7 @@ function Pad(params) {
   worker.postMessage({
     type: "docID",
     docID: this.docID,
+    mergeMode: this.mergeMode,
   })
 
   // establish communication handling with the worker. the convention is for the
@@ -96,6 +98,32 @@ function Pad(params) {
         success: success,
       });
 
+    } else if (data.type == "conflicts") {
+
+      // part of this client's latest commit was dropped or trimmed by the
+      // server while rebasing it. fire an event so the UI can warn the user.
+      var evt = document.createEvent("HTMLEvents");
+      evt.initEvent("pad:conflicts")
+      evt.detail = data.conflicts
+      document.dispatchEvent(evt);
+
+    } else if (data.type == "deleted") {
+
+      // the document was deleted, so nothing typed will be saved. fire an event
+      // so the UI can tell the user.
+      var evt = document.createEvent("HTMLEvents");
+      evt.initEvent("pad:deleted")
+      document.dispatchEvent(evt);
+
+    } else if (data.type == "renamed") {
+
+      // the document was renamed. fire an event so the UI can follow it.
+      this.docID = data.docID;
+      var evt = document.createEvent("HTMLEvents");
+      evt.initEvent("pad:renamed")
+      evt.detail = data.docID
+      document.dispatchEvent(evt);
+
     } else if (data.type == "set-text") {
       this.setState({
         text: data.text,
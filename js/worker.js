@@ -13,9 +13,12 @@ var state = {
   pendingUpdates: [],
   isUpdating: false,
   docID: null,
+  mergeMode: null,
   paused: false,
   currentCommit: null,
   nextDiff: 0,
+  sent: null, // the commit in flight, and the text it should leave the UI with
+  correction: null, // texts the UI is taken between if the server changed it
 };
 
 // commits diff from headText to newText and sends it to the server. parent is
@@ -28,6 +31,10 @@ function commitAndPush(newText, parent) {
     diff: diff,
     id: (+ new Date()), // unique ID allows server to deduplicate requests
   };
+  state.sent = {
+    id: commit.id,
+    text: newText,
+  };
   // create function to keep trying to commit until successful.
   function sendCommit() {
     var req = new XMLHttpRequest();
@@ -37,15 +44,44 @@ function commitAndPush(newText, parent) {
     }
     req.open("put", "/commits/put");
     req.setRequestHeader('doc-id', state.docID);
+    if (state.mergeMode) {
+      // only used by the server if this is the doc's first commit
+      req.setRequestHeader('merge-mode', state.mergeMode);
+    }
     req.send(JSON.stringify(commit));
   }
   sendCommit();
 }
 
+// if the server says this document was renamed, uses its new name from now on
+// and tells the main thread.
+function checkRenamed(req) {
+  var docID = req.getResponseHeader("renamed-to");
+  if (docID && docID != state.docID) {
+    state.docID = docID;
+    postMessage({
+      type: "renamed",
+      docID: docID,
+    });
+  }
+}
+
 // continuously tries to establish connection and apply served updates
 function startContinuousPull() {
 
   function success() {
+    checkRenamed(this);
+    if (this.status == 410) {
+      // the commits this client needs next were compacted away, so start over
+      // from the server's current state.
+      console.log("commits compacted, re-initializing", this.responseText);
+      state.pendingUpdates = [];
+      state.isUpdating = false;
+      state.sent = null;
+      state.correction = null;
+      startContinuousPull();
+      return;
+    }
     var commit = JSON.parse(this.responseText);
     if (commit.parent != state.nextDiff - 1) {
       console.log("bad commit received");
@@ -84,6 +120,15 @@ function startContinuousPull() {
   // receive all subsequent updates.
   var req = new XMLHttpRequest();
   req.addEventListener("load", function() {
+    if (this.status == 410) {
+      // the document was deleted, so there is nothing more to pull.
+      console.log(this.responseText);
+      postMessage({
+        type: "deleted",
+      });
+      return;
+    }
+    checkRenamed(this);
     state.headText = JSON.parse(this.responseText);
     state.head = parseInt(this.getResponseHeader("head"));
     state.nextDiff = state.head + 1;
@@ -135,6 +180,26 @@ function tryNextUpdate() {
   // ends when main accepts a live update. at that point, the logic in the
   // handler should update headText, release isUpdating, and try again.
 
+  var sent = state.sent;
+  if (commit.clientID == state.clientID && sent && sent.id == commit.id) {
+    state.sent = null;
+    var serverText = applyDiff(state.headText, commit.diff);
+    if (serverText != sent.text) {
+      // the server stored this commit differently than it was made, say
+      // merging its lines with conflict markers, so the UI must be taken from
+      // what this client committed to what the server kept, or its next
+      // commit would undo the difference.
+      state.correction = {
+        from: sent.text,
+        to: serverText,
+      };
+      postMessage({
+        type: "get-live-state",
+      });
+      return;
+    }
+  }
+
   if (commit.clientID == state.clientID) {
     // because this commit actually originated from this client, it's been
     // rebasing it's local changes for every commit up to this point, so there
@@ -142,6 +207,14 @@ function tryNextUpdate() {
     // another commit and have an up to date head.
     advanceHeadState();
     state.isUpdating = false;
+    // the server may have been unable to keep all of this client's changes
+    // because others concurrently deleted the text they applied to.
+    if (commit.conflicts) {
+      postMessage({
+        type: "conflicts",
+        conflicts: commit.conflicts,
+      });
+    }
     postMessage({
       type: "commit-received",
       head: state.head,
@@ -183,11 +256,24 @@ function tryUpdateMain(data) {
   currentText = currentText.substring(0, selectionStart) + "\x00" +
                    currentText.substring(selectionStart, selectionEnd) +
                    "\x00" + currentText.substring(selectionEnd);
+  var baseText = state.headText;
   var newDiff = state.currentCommit.diff;
-  var localDiff = getDiff(state.headText, currentText);
+  if (state.correction) {
+    // the UI already has this client's own commit as it was made, so only the
+    // server's changes to it are new.
+    baseText = state.correction.from;
+    newDiff = getDiff(baseText, state.correction.to);
+  }
+  var localDiff = getDiff(baseText, currentText);
   var newLocalDiff = rebase(newDiff, localDiff);
-  var newHeadtext = applyDiff(state.headText, newDiff);
+  var newHeadtext = applyDiff(baseText, newDiff);
   var newText = applyDiff(newHeadtext, newLocalDiff);
+  if (state.sent) {
+    // the commit in flight is moved along with the UI, so it can be told
+    // whether the server kept it as made when it comes back.
+    var sentDiff = rebase(newDiff, getDiff(baseText, state.sent.text));
+    state.sent.next = applyDiff(newHeadtext, sentDiff);
+  }
   var newSelectionStart = newText.indexOf("\x00");
   var newSelectionEnd = newText.lastIndexOf("\x00") - 1;
   newText = newText.replace("\x00", "");
@@ -214,6 +300,7 @@ onmessage = function(evt) {
     // this has been given can the worker initiate a continuous back and forth
     // with the server.
     state.docID = data.docID;
+    state.mergeMode = data.mergeMode;
     startContinuousPull();
   } else if (data.type == "commit") {
     // main is sending its current state to create a commit and send to the
@@ -249,6 +336,24 @@ onmessage = function(evt) {
       // and the next update processed.
       advanceHeadState();
       state.isUpdating = false;
+      if (state.sent && state.sent.next !== undefined) {
+        state.sent.text = state.sent.next;
+        delete state.sent.next;
+      }
+      if (state.correction) {
+        // this was this client's own commit, so main may commit again.
+        state.correction = null;
+        if (state.currentCommit.conflicts) {
+          postMessage({
+            type: "conflicts",
+            conflicts: state.currentCommit.conflicts,
+          });
+        }
+        postMessage({
+          type: "commit-received",
+          head: state.head,
+        });
+      }
       tryNextUpdate();
     } else {
 
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"../pad"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// entry point for the merger conformance harness. it expects the first
+// argument to be the port a git-server.js is listening on, or "rpc" to launch
+// a git-rpc.js and speak to it over stdio instead. the optional second
+// argument is the number of random commit pairs, and histories, to try, and the
+// optional third is the random seed, so a reported divergence can be replayed.
+//
+// every commit pair and history is rebased by both the node merger and the
+// native Go merger. any divergence is printed and the harness exits with
+// status 1.
+func main() {
+	if len(os.Args) < 2 || len(os.Args) > 4 {
+		fmt.Println("Usage: conformance nodePort|rpc [trials [seed]]")
+		os.Exit(2)
+	}
+	trials := 1000
+	seed := time.Now().UnixNano()
+	if len(os.Args) > 2 {
+		trials, _ = strconv.Atoi(os.Args[2])
+	}
+	if len(os.Args) > 3 {
+		seed, _ = strconv.ParseInt(os.Args[3], 10, 64)
+	}
+
+	fmt.Printf("Replaying %v commit pairs and histories with seed %v...\n", trials, seed)
+	var node pad.Merger = pad.MakeNodeMerger(os.Args[1])
+	if os.Args[1] == "rpc" {
+		sm := pad.MakeStdioMerger("git-rpc.js")
+		if err := sm.Start(); err != nil {
+			fmt.Println("FAIL:", err)
+			os.Exit(1)
+		}
+		defer sm.Kill()
+		for !sm.Healthy() {
+			time.Sleep(pad.HEALTHINTERVAL)
+		}
+		node = sm
+	}
+	native := pad.MakeNativeMerger()
+	divergences, err := Conform(node, native, trials, rand.New(rand.NewSource(seed)))
+	if err == nil {
+		var more []Divergence
+		more, err = ConformUnicode(node, native)
+		divergences = append(divergences, more...)
+	}
+	for _, d := range divergences {
+		fmt.Println(d)
+	}
+	if err != nil {
+		fmt.Println("FAIL:", err)
+		os.Exit(1)
+	}
+	if len(divergences) > 0 {
+		fmt.Printf("FAIL: %v of %v trials diverged\n", len(divergences), trials)
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
@@ -0,0 +1,276 @@
+package main
+
+// defines a differential harness which replays randomized pairs of concurrent
+// commits, and stale commits rebased over random histories of several, through
+// two Mergers and reports every input on which they disagree. the node merger
+// is the natural reference since it runs the exact javascript the clients run.
+
+import (
+	"../git"
+	"../pad"
+	"fmt"
+	"math/rand"
+	"reflect"
+)
+
+// characters random texts are made of. includes the null character clients
+// use to mark cursors, since rebase treats it specially, two astral plane
+// characters, which are two UTF-16 code units sharing the same first one, so
+// javascript diffs between them split the pair, and a combining accent.
+const conformanceAlphabet = "abc \n\x00é中😀😃\u0301"
+
+// concurrent edits of texts whose characters are more than one code unit or
+// more than one rune: astral plane characters, combining marks, emoji with
+// skin tone modifiers and flags made of two regional indicators.
+var unicodeFixtures = [][3]string{
+	{"😀", "😀😀", "a😀"},
+	{"a😀b", "ab", "a😀😃b"},
+	{"e\u0301", "e", "e\u0301\u0302"},
+	{"👍🏽", "👍", "👍🏽!"},
+	{"中文😀", "中😀", "中文字😀"},
+	{"🇫🇷", "🇫🇷🇩🇪", "x🇫🇷"},
+}
+
+// Divergence is one randomized input on which two Mergers disagree.
+type Divergence struct {
+	Reason   string
+	Original string        // JSON-ified text both commits were made against
+	C1       pad.Commit    // commit applied first
+	Later    []pad.Commit  // commits applied after C1, if it was not alone
+	C2       pad.Commit    // concurrent commit rebased over C1 and any later ones
+	Rebased  [2]pad.Commit // C2 rebased by the reference and candidate
+	Text     [2]string     // JSON-ified text after applying C1 then rebased C2
+}
+
+func (d Divergence) String() string {
+	later := ""
+	for _, c := range d.Later {
+		later += fmt.Sprintf("\n  then: %v", c)
+	}
+	return fmt.Sprintf("%v diverged\n  original: %v\n  c1: %v%v\n  c2: %v\n"+
+		"  rebased: %v | %v\n  text: %v | %v", d.Reason, d.Original, d.C1, later, d.C2,
+		d.Rebased[0], d.Rebased[1], d.Text[0], d.Text[1])
+}
+
+// Replays trials random commit pairs, and as many random histories of three to
+// five commits with a stale commit made against their first parent, through
+// both mergers, using diffs made by the reference, and returns every one on
+// which the candidate disagrees. stops at the first error from either merger.
+func Conform(reference, candidate pad.Merger, trials int, r *rand.Rand) ([]Divergence, error) {
+	divergences := []Divergence{}
+	for t := 0; t < trials; t++ {
+		original := git.RandomText(r, conformanceAlphabet, r.Intn(20))
+		a := git.Mutate(r, original, conformanceAlphabet)
+		b := git.Mutate(r, original, conformanceAlphabet)
+		d, err := conformTrial(reference, candidate, original, a, b, int64(8*t))
+		if err == nil && d == nil {
+			history := []string{original}
+			for k := 3 + r.Intn(3); k > 0; k-- {
+				history = append(history, git.Mutate(r, history[len(history)-1], conformanceAlphabet))
+			}
+			d, err = conformHistory(reference, candidate, history, b, int64(8*t+2))
+		}
+		if err != nil {
+			return divergences, err
+		}
+		if d != nil {
+			divergences = append(divergences, *d)
+		}
+	}
+	return divergences, nil
+}
+
+// replays the unicode fixtures through both mergers, both ways round, and
+// checks the candidate applies their diffs correctly when they count runes or
+// bytes instead of UTF-16 code units.
+func ConformUnicode(reference, candidate pad.Merger) ([]Divergence, error) {
+	divergences := []Divergence{}
+	for t, f := range unicodeFixtures {
+		for k, pair := range [][2]string{{f[1], f[2]}, {f[2], f[1]}} {
+			id := int64(4*t + 2*k)
+			d, err := conformTrial(reference, candidate, f[0], pair[0], pair[1], id)
+			if err != nil {
+				return divergences, err
+			}
+			if d == nil {
+				d, err = conformUnits(reference, candidate, f[0], pair[0], id)
+			}
+			if err != nil {
+				return divergences, err
+			}
+			if d != nil {
+				divergences = append(divergences, *d)
+			}
+		}
+	}
+	return divergences, nil
+}
+
+// checks the reference's diff from original to a, once converted to runes and
+// to bytes, still takes original to a when the candidate applies it, and
+// converts back to the same UTF-16 diff.
+func conformUnits(reference, candidate pad.Merger, original, a string, id int64) (*Divergence, error) {
+	o := quote(original)
+	diff, err := reference.GetDiff(o, quote(a))
+	if err != nil {
+		return nil, err
+	}
+	c := pad.MakeCommit(1, 0, diff, id)
+	for _, unit := range []string{git.Runes, git.Bytes} {
+		d := &Divergence{Reason: unit + " indexes", Original: o, C1: c}
+		converted, err := pad.ConvertCommit(o, c, unit)
+		if err != nil {
+			// a javascript diff may split a surrogate pair, which no other
+			// unit can express
+			continue
+		}
+		d.C2 = converted
+		text, err := candidate.ApplyDiff(o, converted)
+		if err != nil {
+			return nil, err
+		}
+		back, err := pad.ConvertCommit(o, converted, git.UTF16)
+		if err != nil {
+			return nil, err
+		}
+		d.Rebased = [2]pad.Commit{c, back}
+		if unquote(text) != a || !sameRebase(c, back) {
+			d.Text = [2]string{quote(a), text}
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+// concurrently edits original into a and b, and returns how the mergers
+// diverge, if they do.
+func conformTrial(reference, candidate pad.Merger, original, a, b string, id int64) (*Divergence, error) {
+	o := quote(original)
+	d1, err := reference.GetDiff(o, quote(a))
+	if err != nil {
+		return nil, err
+	}
+	d2, err := reference.GetDiff(o, quote(b))
+	if err != nil {
+		return nil, err
+	}
+	c1 := pad.MakeCommit(1, 0, d1, id)
+	c2 := pad.MakeCommit(2, 0, d2, id+1)
+	d := &Divergence{Original: o, C1: c1, C2: c2}
+
+	// both mergers must produce diffs which actually transform o into b
+	candidateDiff, err := candidate.GetDiff(o, quote(b))
+	if err != nil {
+		return nil, err
+	}
+	text, err := reference.ApplyDiff(o, pad.MakeCommit(2, 0, candidateDiff, id+1))
+	if err != nil {
+		return nil, err
+	}
+	if unquote(text) != b {
+		d.Reason = "getDiff"
+		d.Text = [2]string{quote(b), text}
+		return d, nil
+	}
+
+	mergers := []pad.Merger{reference, candidate}
+	for i, m := range mergers {
+		if d.Rebased[i], err = m.Rebase(c1, c2); err != nil {
+			return nil, err
+		}
+		if d.Text[i], err = m.ApplyDiff(o, c1); err != nil {
+			return nil, err
+		}
+		if d.Text[i], err = m.ApplyDiff(d.Text[i], d.Rebased[i]); err != nil {
+			return nil, err
+		}
+	}
+	if !sameRebase(d.Rebased[0], d.Rebased[1]) {
+		d.Reason = "rebase"
+		return d, nil
+	} else if unquote(d.Text[0]) != unquote(d.Text[1]) {
+		d.Reason = "applyDiff"
+		return d, nil
+	}
+	return nil, nil
+}
+
+// commits the texts of history one after another, then rebases a stale commit
+// from its first text to b over all of them, one at a time as the pad server
+// does, and returns how the mergers diverge, if they do. a candidate which can
+// compose commits must also squash the history into one with the same effect.
+func conformHistory(reference, candidate pad.Merger, history []string, b string, id int64) (*Divergence, error) {
+	o := quote(history[0])
+	commits := make([]pad.Commit, len(history)-1)
+	for i := range commits {
+		diff, err := reference.GetDiff(quote(history[i]), quote(history[i+1]))
+		if err != nil {
+			return nil, err
+		}
+		commits[i] = pad.MakeCommit(1, i, diff, id+int64(i)+1)
+	}
+	diff, err := reference.GetDiff(o, quote(b))
+	if err != nil {
+		return nil, err
+	}
+	stale := pad.MakeCommit(2, 0, diff, id)
+	d := &Divergence{Original: o, C1: commits[0], Later: commits[1:], C2: stale}
+
+	for i, m := range []pad.Merger{reference, candidate} {
+		if d.Rebased[i], err = pad.RebaseOver(m, commits, stale); err != nil {
+			return nil, err
+		}
+		d.Text[i] = o
+		for _, c := range append(commits, d.Rebased[i]) {
+			if d.Text[i], err = m.ApplyDiff(d.Text[i], c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !sameRebase(d.Rebased[0], d.Rebased[1]) {
+		d.Reason = "rebase over history"
+		return d, nil
+	} else if unquote(d.Text[0]) != unquote(d.Text[1]) {
+		d.Reason = "applyDiff over history"
+		return d, nil
+	}
+
+	if composer, ok := candidate.(pad.Composer); ok {
+		squash := commits[0]
+		for _, c := range commits[1:] {
+			if squash, err = composer.Compose(squash, c); err != nil {
+				return nil, err
+			}
+		}
+		text, err := candidate.ApplyDiff(o, squash)
+		if err != nil {
+			return nil, err
+		}
+		if want := history[len(history)-1]; unquote(text) != want {
+			d.Reason = "compose"
+			d.Rebased = [2]pad.Commit{}
+			d.Text = [2]string{quote(want), text}
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+// rebased commits agree if they have the same parent and equivalent diffs.
+// conflict reports are not part of the javascript, so they do not matter.
+func sameRebase(c1, c2 pad.Commit) bool {
+	if len(c1.Diff) == 0 && len(c2.Diff) == 0 {
+		return c1.Parent == c2.Parent
+	}
+	return c1.Parent == c2.Parent && reflect.DeepEqual(c1.Diff, c2.Diff)
+}
+
+// texts are JSON-ified, exactly as the mergers are given them
+func quote(text string) string {
+	return git.Quote(text)
+}
+
+func unquote(text string) string {
+	s, _ := git.Unquote([]byte(text))
+	return s
+}
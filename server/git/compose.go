@@ -0,0 +1,172 @@
+package git
+
+// composition of diffs. Compose(d1, d2) is a single diff with the same effect
+// as applying d1 and then d2, which lets a long run of commits be squashed into
+// one diff and applied in a single step. rebasing over a composed diff is not
+// the same as rebasing over each of its diffs in turn: given "b", d1 inserting
+// "a" before it and d2 deleting both, an insert of "a" made against "b" lands
+// inside d2's delete, and is dropped, when rebased over d1 and then d2, but is
+// kept when rebased over their composition, which only deletes "b".
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// part of the text after applying d1, described in terms of the original text.
+// kept text copies size code units starting at orig. inserted text is val,
+// placed just before orig.
+type piece struct {
+	orig     int
+	size     int
+	val      []uint16
+	inserted bool
+}
+
+func (p piece) length() int {
+	if p.inserted {
+		return len(p.val)
+	}
+	return p.size
+}
+
+// a deleted range [start, end) of the original text.
+type span struct {
+	start int
+	end   int
+}
+
+// returns a diff which transforms text the same way as applying d1 and then
+// d2. both must be valid diffs with operations in increasing index order.
+// fails if either is not, or if d2 reaches past any text d1 could give.
+func Compose(d1, d2 Diff) (Diff, error) {
+	if err := d1.validateOps(); err != nil {
+		return nil, err
+	}
+	if err := d2.validateOps(); err != nil {
+		return nil, err
+	}
+
+	// describe the text after d1 as pieces of the original and inserted text.
+	// the original's length is unknown, so the last piece keeps everything.
+	pieces := []piece{}
+	deletes := []span{}
+	pos := 0
+	for _, op := range d1 {
+		if op.Index > pos {
+			pieces = append(pieces, piece{orig: pos, size: op.Index - pos})
+			pos = op.Index
+		}
+		if op.Type == Insert {
+			pieces = append(pieces, piece{orig: pos, val: encode(op.Val), inserted: true})
+		} else if op.Type == Delete {
+			deletes = append(deletes, span{pos, pos + op.Size})
+			pos += op.Size
+		}
+	}
+	pieces = append(pieces, piece{orig: pos, size: math.MaxInt32})
+
+	// walk d2 over those pieces, copying what it keeps into output. deleting
+	// inserted text simply drops it; deleting kept text deletes the original.
+	output := []piece{}
+	next := 0   // next piece to copy
+	offset := 0 // units of the next piece already copied or deleted
+	cursor := 0 // position in the text after d1
+	advance := func(n int, keep bool) {
+		for n > 0 && next < len(pieces) {
+			p := pieces[next]
+			take := p.length() - offset
+			if take > n {
+				take = n
+			}
+			if p.inserted && keep {
+				output = append(output, piece{orig: p.orig, val: p.val[offset : offset+take], inserted: true})
+			} else if keep {
+				output = append(output, piece{orig: p.orig + offset, size: take})
+			} else if !p.inserted {
+				deletes = append(deletes, span{p.orig + offset, p.orig + offset + take})
+			}
+			offset += take
+			n -= take
+			cursor += take
+			if offset == p.length() {
+				next += 1
+				offset = 0
+			}
+		}
+	}
+	for i, op := range d2 {
+		advance(op.Index-cursor, true)
+		if next == len(pieces) {
+			return nil, fmt.Errorf("op %v at %v is past the end of the text", i, op.Index)
+		}
+		if op.Type == Insert {
+			orig := pieces[next].orig
+			if !pieces[next].inserted {
+				orig += offset
+			}
+			output = append(output, piece{orig: orig, val: encode(op.Val), inserted: true})
+		} else if op.Type == Delete {
+			advance(op.Size, false)
+			if next == len(pieces) {
+				return nil, fmt.Errorf("op %v at %v deletes past the end of the text", i, op.Index)
+			}
+		}
+	}
+	for ; next < len(pieces); next++ {
+		if p := pieces[next]; p.inserted {
+			output = append(output, piece{orig: p.orig, val: p.val[offset:], inserted: true})
+		}
+		offset = 0
+	}
+
+	// merge overlapping and touching deletes
+	sort.SliceStable(deletes, func(i, j int) bool {
+		return deletes[i].start < deletes[j].start
+	})
+	merged := []span{}
+	for _, d := range deletes {
+		if d.end <= d.start {
+			continue
+		}
+		if n := len(merged); n > 0 && d.start <= merged[n-1].end {
+			if d.end > merged[n-1].end {
+				merged[n-1].end = d.end
+			}
+		} else {
+			merged = append(merged, d)
+		}
+	}
+
+	// interleave deletes and inserts by index. an insert touching a deleted
+	// range is moved just past it, so deletes come before inserts at the same
+	// place, just as GetDiff orders them.
+	ops := Diff{}
+	k := 0
+	for _, p := range output {
+		if !p.inserted {
+			continue
+		}
+		index := p.orig
+		for k < len(merged) && merged[k].end < index {
+			ops = append(ops, Op{Type: Delete, Index: merged[k].start, Size: merged[k].end - merged[k].start})
+			k += 1
+		}
+		if k < len(merged) && merged[k].start <= index {
+			index = merged[k].end
+		}
+		if len(p.val) > 0 {
+			ops = append(ops, Op{Type: Insert, Index: index, Val: decode(p.val)})
+		}
+	}
+	for ; k < len(merged); k++ {
+		ops = append(ops, Op{Type: Delete, Index: merged[k].start, Size: merged[k].end - merged[k].start})
+	}
+
+	// the delete an insert was moved past may not have been emitted yet
+	sort.SliceStable(ops, func(i, j int) bool {
+		return ops[i].Index < ops[j].Index
+	})
+	return collapse(ops), nil
+}
@@ -0,0 +1,81 @@
+package git
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestCompose(t *testing.T) {
+	cases := []struct {
+		text   string
+		d1, d2 Diff
+	}{
+		{"", Diff{}, Diff{}},
+		{"abc", Diff{{Type: Insert, Index: 1, Val: "x"}}, Diff{{Type: Delete, Index: 1, Size: 1}}},
+		{"abc", Diff{{Type: Delete, Index: 0, Size: 2}}, Diff{{Type: Insert, Index: 1, Val: "yz"}}},
+		{"abc", Diff{{Type: Insert, Index: 3, Val: "de"}}, Diff{{Type: Delete, Index: 2, Size: 2}}},
+
+		// javascript diffs between astral plane characters may only replace
+		// one half of their surrogate pair
+		{"😀", Diff{{Type: Delete, Index: 1, Size: 1}, {Type: Insert, Index: 2, Val: decode([]uint16{0xde03})}},
+			Diff{{Type: Insert, Index: 2, Val: "!"}}},
+		{"a😀", Diff{{Type: Delete, Index: 2, Size: 1}, {Type: Insert, Index: 3, Val: decode([]uint16{0xde03})}},
+			Diff{{Type: Delete, Index: 2, Size: 1}, {Type: Insert, Index: 3, Val: decode([]uint16{0xde00})}}},
+	}
+	for _, c := range cases {
+		want := ApplyDiff(ApplyDiff(c.text, c.d1), c.d2)
+		composed, err := Compose(c.d1, c.d2)
+		if err != nil {
+			t.Fatalf("Compose(%v, %v): %v", c.d1, c.d2, err)
+		}
+		if out := ApplyDiff(c.text, composed); out != want {
+			t.Errorf("Compose(%v, %v) = %v, which gives %q from %q, not %q", c.d1, c.d2, composed, out, c.text, want)
+		}
+	}
+}
+
+func TestComposeRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	for trial := 0; trial < 2000; trial++ {
+		a := RandomText(r, testAlphabet, r.Intn(20))
+		b := Mutate(r, a, testAlphabet)
+		c := Mutate(r, b, testAlphabet)
+		d1 := GetDiff(a, b)
+		d2 := MyersDiff(b, c)
+		composed, err := Compose(d1, d2)
+		if err != nil {
+			t.Fatalf("Compose(%v, %v): %v", d1, d2, err)
+		}
+		if err := composed.Validate(); err != nil {
+			t.Fatalf("Compose(%v, %v) = %v: %v", d1, d2, composed, err)
+		}
+		if out := ApplyDiff(a, composed); out != c {
+			t.Fatalf("Compose(%v, %v) = %v, which gives %q from %q, not %q", d1, d2, composed, out, a, c)
+		}
+
+		// squashing three diffs either way round has the same effect
+		d := Mutate(r, c, testAlphabet)
+		d3 := GetDiff(c, d)
+		d23, _ := Compose(d2, d3)
+		left, err1 := Compose(composed, d3)
+		right, err2 := Compose(d1, d23)
+		if err1 != nil || err2 != nil || ApplyDiff(a, left) != d || ApplyDiff(a, right) != d {
+			t.Fatalf("composing %v, %v and %v does not give %q from %q", d1, d2, d3, d, a)
+		}
+	}
+}
+
+// ops past the end of any text the first diff could give are errors, however
+// far past it they are
+func TestComposeOutOfRange(t *testing.T) {
+	d1 := Diff{{Type: Insert, Index: 1, Val: "x"}}
+	for _, d2 := range []Diff{
+		{{Type: Insert, Index: 3000000000, Val: "y"}},
+		{{Type: Delete, Index: 0, Size: 3000000000}},
+		{{Type: Insert, Index: -1, Val: "y"}},
+	} {
+		if composed, err := Compose(d1, d2); err == nil {
+			t.Errorf("Compose(%v, %v) = %v", d1, d2, composed)
+		}
+	}
+}
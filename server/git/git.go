@@ -0,0 +1,506 @@
+package git
+
+// purely functional utility functions for git operations. this is a port of
+// js/git.js so the pad server can rebase and apply commits itself instead of
+// asking a node process to do it. it exports GetDiff, Rebase and ApplyDiff.
+//
+// indexes and sizes count UTF-16 code units, exactly like javascript strings
+// do, so diffs produced by the browser apply here unchanged and vice versa.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	Insert = "Insert"
+	Delete = "Delete"
+)
+
+// a single operation of a diff. Inserts carry Val, Deletes carry Size.
+type Op struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+	Val   string `json:"val,omitempty"`
+	Size  int    `json:"size,omitempty"`
+}
+
+// an ordered list of operations, all relative to the same original text.
+type Diff []Op
+
+// javascript clients read op.val and op.size without checking they exist, so
+// always write the field that belongs to the op's type, even if it is empty.
+func (op Op) MarshalJSON() ([]byte, error) {
+	if op.Type == Delete {
+		return json.Marshal(struct {
+			Type  string `json:"type"`
+			Index int    `json:"index"`
+			Size  int    `json:"size"`
+		}{op.Type, op.Index, op.Size})
+	}
+	return json.Marshal(struct {
+		Type  string          `json:"type"`
+		Index int             `json:"index"`
+		Val   json.RawMessage `json:"val"`
+	}{op.Type, op.Index, json.RawMessage(Quote(op.Val))})
+}
+
+// reads val with Unquote, so inserts of half a surrogate pair keep it.
+func (op *Op) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		Type  string          `json:"type"`
+		Index int             `json:"index"`
+		Val   json.RawMessage `json:"val"`
+		Size  int             `json:"size"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*op = Op{Type: fields.Type, Index: fields.Index, Size: fields.Size}
+	if len(fields.Val) > 0 && string(fields.Val) != "null" {
+		val, err := Unquote(fields.Val)
+		if err != nil {
+			return err
+		}
+		op.Val = val
+	}
+	return nil
+}
+
+// past this many cells, the dynamic program below takes too much time and
+// memory, so GetDiff uses MyersDiff instead.
+const maxDynamicCells = 1 << 22
+
+// creates diff from a -> b
+func GetDiff(a, b string) Diff {
+	ra := runes(a)
+	rb := runes(b)
+	n := len(ra)
+	m := len(rb)
+	if (n+1)*(m+1) > maxDynamicCells {
+		return MyersDiff(a, b)
+	}
+
+	// perform dynamic program to create diff. cost[i][j] is the number of
+	// operations needed to transform a[:i] into b[:j]. the dynamic program runs
+	// over code points rather than code units so a diff never splits a
+	// surrogate pair, but the resulting indexes are still in code units.
+	cost := make([][]int32, n+1)
+	for i := range cost {
+		cost[i] = make([]int32, m+1)
+	}
+	for i := 0; i <= n; i++ {
+		for j := 0; j <= m; j++ {
+			if i == 0 && j == 0 {
+				continue
+			}
+			cost[i][j] = best(cost, ra, rb, i, j)
+		}
+	}
+
+	// walk back through the choices, emitting operations in reverse.
+	units := prefixUnits(ra)
+	ops := Diff{}
+	i, j := n, m
+	for i > 0 || j > 0 {
+		switch choice(cost, ra, rb, i, j) {
+		case choiceInsert:
+			ops = append(ops, Op{Type: Insert, Index: units[i], Val: fromRunes(rb[j-1 : j])})
+			j -= 1
+		case choiceDelete:
+			ops = append(ops, Op{Type: Delete, Index: units[i-1], Size: runeLen(ra[i-1])})
+			i -= 1
+		default:
+			i -= 1
+			j -= 1
+		}
+	}
+	for l, r := 0, len(ops)-1; l < r; l, r = l+1, r-1 {
+		ops[l], ops[r] = ops[r], ops[l]
+	}
+
+	return collapse(ops)
+}
+
+const (
+	choiceInsert = iota
+	choiceDelete
+	choiceSame
+)
+
+// picks the cheapest way to reach (i, j), preferring inserts, then deletes,
+// then matching characters when costs tie, just as js/git.js does.
+func choice(cost [][]int32, a, b []rune, i, j int) int {
+	pick := -1
+	var min int32
+	if j > 0 {
+		pick = choiceInsert
+		min = cost[i][j-1] + 1
+	}
+	if i > 0 && (pick < 0 || cost[i-1][j]+1 < min) {
+		pick = choiceDelete
+		min = cost[i-1][j] + 1
+	}
+	if i > 0 && j > 0 && a[i-1] == b[j-1] && cost[i-1][j-1] < min {
+		pick = choiceSame
+	}
+	return pick
+}
+
+// cost of the best way to reach (i, j), computed from already filled cells.
+func best(cost [][]int32, a, b []rune, i, j int) int32 {
+	switch choice(cost, a, b, i, j) {
+	case choiceInsert:
+		return cost[i][j-1] + 1
+	case choiceDelete:
+		return cost[i-1][j] + 1
+	}
+	return cost[i-1][j-1]
+}
+
+// collapse adjacent operations of the same kind.
+func collapse(ops Diff) Diff {
+	if len(ops) == 0 {
+		return Diff{}
+	}
+	diff := Diff{}
+	runningOp := ops[0]
+	for i := 1; i < len(ops); i += 1 {
+		if runningOp.Type == Insert &&
+			ops[i].Type == Insert &&
+			ops[i].Index == runningOp.Index {
+			runningOp.Val += ops[i].Val
+		} else if runningOp.Type == Delete &&
+			ops[i].Type == Delete &&
+			ops[i].Index == runningOp.Index+runningOp.Size {
+			runningOp.Size += ops[i].Size
+		} else {
+			diff = append(diff, runningOp)
+			runningOp = ops[i]
+		}
+	}
+	diff = append(diff, runningOp)
+	return diff
+}
+
+// returns an error describing the first op which is not an Insert or Delete,
+// has a negative index or size, starts before the end of the op before it, or
+// inserts half of a surrogate pair. only diffs which pass can be applied and
+// rebased meaningfully. javascript diffs which split a pair pass once given to
+// Realign.
+func (d Diff) Validate() error {
+	if err := d.validateOps(); err != nil {
+		return err
+	}
+	for i, op := range d {
+		if op.Type == Insert && hasLoneSurrogate(encode(op.Val)) {
+			return fmt.Errorf("op %v inserts half of a surrogate pair", i)
+		}
+	}
+	return nil
+}
+
+// checks the types, order and bounds of d's operations
+func (d Diff) validateOps() error {
+	pos := 0
+	for i, op := range d {
+		if op.Type != Insert && op.Type != Delete {
+			return fmt.Errorf("op %v has unknown type %q", i, op.Type)
+		} else if op.Index < 0 {
+			return fmt.Errorf("op %v has negative index %v", i, op.Index)
+		} else if op.Index < pos {
+			return fmt.Errorf("op %v at %v is out of order, before %v", i, op.Index, pos)
+		}
+		pos = op.Index
+		if op.Type == Delete {
+			if op.Size < 0 {
+				return fmt.Errorf("op %v has negative size %v", i, op.Size)
+			}
+			pos += op.Size
+		}
+	}
+	return nil
+}
+
+// returns an error describing the first op of d which reaches past the end of
+// a text length code units long. d's ops must otherwise be valid.
+func (d Diff) CheckBounds(length int) error {
+	for i, op := range d {
+		if op.Index > length {
+			return fmt.Errorf("op %v at %v is past the end of the text, at %v", i, op.Index, length)
+		} else if op.Type == Delete && op.Size > length-op.Index {
+			return fmt.Errorf("op %v deletes %v past the end of the text, at %v", i, op.Index+op.Size, length)
+		}
+	}
+	return nil
+}
+
+// returns the result of applying diff to content
+func ApplyDiff(content string, diff Diff) string {
+	text := encode(content)
+	index := 0
+	output := make([]uint16, 0, len(text))
+	for _, op := range diff {
+		output = append(output, substring(text, index, op.Index)...)
+		index = op.Index
+		if op.Type == Insert {
+			output = append(output, encode(op.Val)...)
+		} else if op.Type == Delete {
+			index += op.Size
+		}
+	}
+	output = append(output, substring(text, index, len(text))...)
+	return decode(output)
+}
+
+// returns the diff which undoes diff, given the content it was made against.
+// the content is needed to recover the characters diff deletes.
+func Invert(content string, diff Diff) Diff {
+	text := encode(content)
+	inverse := Diff{}
+	shift := 0
+	for _, op := range diff {
+		if op.Type == Insert {
+			inverse = append(inverse, Op{Type: Delete, Index: op.Index + shift, Size: Len(op.Val)})
+			shift += Len(op.Val)
+		} else if op.Type == Delete {
+			deleted := decode(substring(text, op.Index, op.Index+op.Size))
+			inverse = append(inverse, Op{Type: Insert, Index: op.Index + shift, Val: deleted})
+			shift -= op.Size
+		}
+	}
+	return collapse(inverse)
+}
+
+// given two diffs to the same document, return a d2' which captures as many of
+// the changes in d2 as possible and can be applied to the document + d1.
+// unlike the javascript version, d2 is left untouched. ensures cursor
+// locations, marked by null characters, are not deleted, but rather maintained
+// into reasonable locations through deletions.
+func Rebase(d1, d2 Diff) Diff {
+	rebased, _ := RebaseConflicts(d1, d2)
+	return rebased
+}
+
+const (
+	Dropped = "Dropped" // op of d2 was left out entirely
+	Trimmed = "Trimmed" // delete of d2 was shrunk to what d1 left behind
+)
+
+// an op of d2 which rebase could not keep as it was, because d1 deleted some or
+// all of the text it applied to.
+type Conflict struct {
+	Type string `json:"type"`
+	Op   Op     `json:"op"`
+}
+
+// same as Rebase, but also reports the ops of d2 which were dropped or trimmed,
+// in the order they appear in d2. inserts consisting only of cursors are not
+// reported, since the cursors themselves are kept.
+func RebaseConflicts(d1, d2 Diff) (Diff, []Conflict) {
+
+	// the conflict, if any, of each op of d2
+	original := d2
+	conflicts := make([]string, len(d2))
+	conflict := func(j int, kind string) {
+		if conflicts[j] != Dropped {
+			conflicts[j] = kind
+		}
+	}
+
+	// cumulative state as we iterate through with two fingers
+	d2 = append(Diff{}, d2...)
+	i := 0
+	j := 0
+	output := Diff{}
+	shift := 0
+
+	// possible options at each stage
+
+	doOldInsert := func() {
+		shift += Len(d1[i].Val)
+		i += 1
+	}
+	doOldDelete := func() {
+		// we want to ignore any inserts contained strictly in the bounds. we also
+		// want to ignore any deletes contained *strictly* in the bounds. we want to
+		// modify partially overlapping deletes.
+		for j < len(d2) && d2[j].Index < d1[i].Index+d1[i].Size {
+			if d2[j].Type == Insert {
+				// ignore it. account for cursor positions marked with null char.
+				cursorIndex1 := strings.Index(d2[j].Val, "\x00")
+				cursorIndex2 := strings.LastIndex(d2[j].Val, "\x00")
+				insertCursor := func() {
+					output = append(output, Op{
+						Type:  Insert,
+						Index: d1[i].Index + shift,
+						Val:   "\x00",
+					})
+				}
+				if cursorIndex1 >= 0 {
+					insertCursor()
+				}
+				if cursorIndex2 > cursorIndex1 {
+					insertCursor()
+				}
+				if strings.Trim(d2[j].Val, "\x00") != "" {
+					conflict(j, Dropped)
+				}
+			} else if d2[j].Type == Delete {
+				if d2[j].Index+d2[j].Size > d1[i].Index+d1[i].Size {
+					// old delete ends in the middle of the next new delete. shrink the
+					// new delete so it starts at the end of this old delete and still
+					// only deletes the same characters, then let it be processed next.
+					d2[j].Size = d2[j].Index + d2[j].Size - (d1[i].Index + d1[i].Size)
+					d2[j].Index = d1[i].Index + d1[i].Size
+					conflict(j, Trimmed)
+					break
+				} else {
+					// delete is completely contained, ignore.
+					conflict(j, Dropped)
+				}
+			}
+			j += 1
+		}
+		shift -= d1[i].Size
+		i += 1
+	}
+	doNewInsert := func() {
+		op := d2[j]
+		op.Index += shift
+		output = append(output, op)
+		j += 1
+	}
+	doNewDelete := func() {
+		// we want to adjust this delete's starting index appropriately. we
+		// also want to adjust this delete's size based on any ops this delete
+		// strictly contains.
+		op := d2[j]
+		originalIndex := op.Index
+		originalSize := op.Size
+		op.Index += shift
+		for i < len(d1) && d1[i].Index < originalIndex+originalSize {
+			if d1[i].Type == Insert {
+				// need to increase the size to include this insert
+				op.Size += Len(d1[i].Val)
+				shift += Len(d1[i].Val)
+			} else if d1[i].Type == Delete {
+				// must account for overlap with an old delete. the old delete could be
+				// completely contained within this delete and or it could extend
+				// beyond it.
+				conflict(j, Trimmed)
+				if d1[i].Index+d1[i].Size < originalIndex+originalSize {
+					// old delete is completely contained within this one
+					op.Size -= d1[i].Size
+					shift -= d1[i].Size
+				} else {
+					// new delete ends inside of old delete. just end new delete at
+					// beginning of old delete since the rest of the characters will be
+					// gone due to the old delete. the old delete is processed next.
+					op.Size -= originalIndex + originalSize - d1[i].Index
+					break
+				}
+			}
+			i += 1
+		}
+		output = append(output, op)
+		j += 1
+	}
+
+	// ops of an unknown type are skipped rather than looping forever.
+	doOld := func() {
+		switch d1[i].Type {
+		case Insert:
+			doOldInsert()
+		case Delete:
+			doOldDelete()
+		default:
+			i += 1
+		}
+	}
+	doNew := func() {
+		switch d2[j].Type {
+		case Insert:
+			doNewInsert()
+		case Delete:
+			doNewDelete()
+		default:
+			j += 1
+		}
+	}
+
+	for i < len(d1) && j < len(d2) {
+		if d1[i].Index < d2[j].Index {
+			doOld()
+		} else if d2[j].Index < d1[i].Index {
+			doNew()
+		} else { // must be equal
+			if d1[i].Type == Insert {
+				doOldInsert()
+			} else if d2[j].Type == Insert {
+				doNewInsert()
+			} else if d1[i].Type == Delete {
+				doOldDelete()
+			} else {
+				doNew()
+			}
+		}
+	}
+	for j < len(d2) {
+		doNew()
+	}
+
+	reported := []Conflict{}
+	for j, kind := range conflicts {
+		if kind != "" {
+			reported = append(reported, Conflict{kind, original[j]})
+		}
+	}
+	return output, reported
+}
+
+// returns the length of s as javascript would, in UTF-16 code units.
+func Len(s string) int {
+	n := 0
+	for _, r := range runes(s) {
+		n += runeLen(r)
+	}
+	return n
+}
+
+func runeLen(r rune) int {
+	if r >= 0x10000 && r <= 0x10FFFF {
+		return 2
+	}
+	return 1
+}
+
+// offsets in code units of each code point of s, plus the total length.
+func prefixUnits(s []rune) []int {
+	units := make([]int, len(s)+1)
+	for i, r := range s {
+		units[i+1] = units[i] + runeLen(r)
+	}
+	return units
+}
+
+// behaves like javascript's String.prototype.substring: bounds are clamped to
+// the string and swapped if given in the wrong order.
+func substring(s []uint16, start, end int) []uint16 {
+	clamp := func(x int) int {
+		if x < 0 {
+			return 0
+		}
+		if x > len(s) {
+			return len(s)
+		}
+		return x
+	}
+	start = clamp(start)
+	end = clamp(end)
+	if start > end {
+		start, end = end, start
+	}
+	return s[start:end]
+}
@@ -0,0 +1,188 @@
+package git
+
+// line-oriented diffs and merges, for documents such as source code and config
+// files where interleaving two people's edits to the same line character by
+// character produces nonsense. diffs still have the usual format, but every op
+// covers whole lines. instead of rebasing one diff over another, MergeLines
+// does a three-way merge of whole texts, keeping both sides of any conflict
+// between git-style markers.
+
+import "strings"
+
+const (
+	Marked = "Marked" // both sides changed the same lines, kept between markers
+
+	MarkerHead     = "<<<<<<< head\n"
+	MarkerSep      = "=======\n"
+	MarkerIncoming = ">>>>>>> incoming\n"
+)
+
+// splits s into lines, each keeping its "\n". only the last may lack one.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// marks which lines of a and b are not part of a longest common subsequence
+// of them, by running MyersDiff's search over lines instead of characters.
+// each distinct line is interned as a single rune for the comparison.
+func compareLines(a, b []string) (removed, added []bool) {
+	ids := make(map[string]rune)
+	intern := func(lines []string) []rune {
+		tokens := make([]rune, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = rune(len(ids))
+				ids[line] = id
+			}
+			tokens[i] = id
+		}
+		return tokens
+	}
+	m := &myers{a: intern(a), b: intern(b)}
+	m.removed = make([]bool, len(a))
+	m.added = make([]bool, len(b))
+	m.compare(0, len(a), 0, len(b))
+	return m.removed, m.added
+}
+
+// creates diff from a -> b in which every op inserts or deletes whole lines.
+func LineDiff(a, b string) Diff {
+	la := splitLines(a)
+	lb := splitLines(b)
+	removed, added := compareLines(la, lb)
+
+	ops := Diff{}
+	index := 0 // code units of a before line i
+	i, j := 0, 0
+	for i < len(la) || j < len(lb) {
+		if i < len(la) && removed[i] {
+			size := 0
+			for ; i < len(la) && removed[i]; i++ {
+				size += Len(la[i])
+			}
+			ops = append(ops, Op{Type: Delete, Index: index, Size: size})
+			index += size
+		} else if j < len(lb) && added[j] {
+			start := j
+			for j < len(lb) && added[j] {
+				j += 1
+			}
+			ops = append(ops, Op{Type: Insert, Index: index, Val: strings.Join(lb[start:j], "")})
+		} else {
+			index += Len(la[i])
+			i += 1
+			j += 1
+		}
+	}
+	return collapse(ops)
+}
+
+// merges the changes made from base to head with those made from base to
+// incoming, line by line. where only one side changed a run of lines, its
+// change is taken. where both did, differently, both versions are kept one
+// after the other between markers, and the whole marked block is reported as
+// a Marked conflict: an Insert at its index in the merged text.
+func MergeLines(base, head, incoming string) (string, []Conflict) {
+	lb := splitLines(base)
+	lh := splitLines(head)
+	li := splitLines(incoming)
+	inHead := matches(lb, lh)
+	inIncoming := matches(lb, li)
+
+	merged := []string{}
+	conflicts := []Conflict{}
+	units := 0 // length of merged so far
+	emit := func(lines ...string) {
+		for _, line := range lines {
+			merged = append(merged, line)
+			units += Len(line)
+		}
+	}
+
+	// walk all three texts together. lines of base kept by both sides are
+	// copied; the runs of lines between them are merged as a whole.
+	b, h, i := 0, 0, 0
+	for b <= len(lb) {
+		next := b
+		for next < len(lb) && (inHead[next] < 0 || inIncoming[next] < 0) {
+			next += 1
+		}
+		nextH, nextI := len(lh), len(li)
+		if next < len(lb) {
+			nextH, nextI = inHead[next], inIncoming[next]
+		}
+
+		baseRun := lb[b:next]
+		headRun := lh[h:nextH]
+		incomingRun := li[i:nextI]
+		if sameLines(headRun, baseRun) {
+			emit(incomingRun...)
+		} else if sameLines(incomingRun, baseRun) || sameLines(headRun, incomingRun) {
+			emit(headRun...)
+		} else {
+			start := units
+			emit(MarkerHead)
+			emit(terminated(headRun)...)
+			emit(MarkerSep)
+			emit(terminated(incomingRun)...)
+			emit(MarkerIncoming)
+			block := strings.Join(merged[len(merged)-len(headRun)-len(incomingRun)-3:], "")
+			conflicts = append(conflicts, Conflict{Marked, Op{Type: Insert, Index: start, Val: block}})
+		}
+
+		if next == len(lb) {
+			break
+		}
+		emit(lb[next])
+		b, h, i = next+1, nextH+1, nextI+1
+	}
+	return strings.Join(merged, ""), conflicts
+}
+
+// returns, for each line of a, the index of the line of b it is matched with
+// in a longest common subsequence, or -1 if it is not in one.
+func matches(a, b []string) []int {
+	removed, added := compareLines(a, b)
+	match := make([]int, len(a))
+	j := 0
+	for i := range a {
+		if removed[i] {
+			match[i] = -1
+			continue
+		}
+		for added[j] {
+			j += 1
+		}
+		match[i] = j
+		j += 1
+	}
+	return match
+}
+
+func sameLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// returns lines with a "\n" added to the last one if it lacks one, so a marker
+// after them starts on its own line.
+func terminated(lines []string) []string {
+	if len(lines) == 0 || strings.HasSuffix(lines[len(lines)-1], "\n") {
+		return lines
+	}
+	out := append([]string{}, lines...)
+	out[len(out)-1] += "\n"
+	return out
+}
@@ -0,0 +1,44 @@
+package git
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineDiff(t *testing.T) {
+	a, b := "one\ntwo\nthree\n", "one\n2\nthree\nfour"
+	diff := LineDiff(a, b)
+	want := Diff{{Type: Delete, Index: 4, Size: 4}, {Type: Insert, Index: 8, Val: "2\n"}, {Type: Insert, Index: 14, Val: "four"}}
+	if !reflect.DeepEqual(diff, want) {
+		t.Fatalf("LineDiff(%q, %q) = %v, not %v", a, b, diff, want)
+	}
+	if out := ApplyDiff(a, diff); out != b {
+		t.Fatalf("LineDiff(%q, %q) = %v, which gives %q", a, b, diff, out)
+	}
+}
+
+func TestMergeLines(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\n"
+
+	// changes to different lines are both taken
+	merged, conflicts := MergeLines(base, "one\n2\nthree\nfour\n", "one\ntwo\nthree\n4\n")
+	if want := "one\n2\nthree\n4\n"; merged != want || len(conflicts) != 0 {
+		t.Fatalf("merging changes to different lines gives %q with %v, not %q", merged, conflicts, want)
+	}
+
+	// changes to the same lines are kept side by side between markers, and
+	// the marked block is reported as a conflict where it is in the result
+	merged, conflicts = MergeLines(base, "one\n2\nthree\nfour\n", "one\nTWO\nthree\nfour\n")
+	block := MarkerHead + "2\n" + MarkerSep + "TWO\n" + MarkerIncoming
+	if want := "one\n" + block + "three\nfour\n"; merged != want {
+		t.Fatalf("merging changes to the same line gives %q, not %q", merged, want)
+	}
+	want := []Conflict{{Marked, Op{Type: Insert, Index: 4, Val: block}}}
+	if !reflect.DeepEqual(conflicts, want) {
+		t.Fatalf("merging changes to the same line reports %v, not %v", conflicts, want)
+	}
+	c := conflicts[0].Op
+	if got := ApplyDiff(merged, Diff{{Type: Delete, Index: c.Index, Size: Len(c.Val)}}); got != "one\nthree\nfour\n" {
+		t.Fatalf("the marked block is not at %v of %q", c.Index, merged)
+	}
+}
@@ -0,0 +1,144 @@
+package git
+
+// linear space Myers diff. GetDiff's dynamic program is quadratic in both time
+// and memory, which is hopeless for large documents, so past a certain size
+// GetDiff uses this instead. the edit script is equally short but, where there
+// are several shortest scripts, may pick a different one than the javascript.
+//
+// see "An O(ND) Difference Algorithm and Its Variations", Eugene W. Myers.
+
+// creates diff from a -> b in O((n+m)D) time and O(n+m) space, where D is the
+// number of characters inserted and deleted. operations have the same format
+// and are collapsed the same way as GetDiff's.
+func MyersDiff(a, b string) Diff {
+	m := &myers{
+		a: runes(a),
+		b: runes(b),
+	}
+	m.removed = make([]bool, len(m.a))
+	m.added = make([]bool, len(m.b))
+	m.compare(0, len(m.a), 0, len(m.b))
+
+	// walk both texts together, turning each run of removed and added
+	// characters into a single operation. deletes come before inserts at the
+	// same position, just as GetDiff orders them.
+	units := prefixUnits(m.a)
+	ops := Diff{}
+	i, j := 0, 0
+	for i < len(m.a) || j < len(m.b) {
+		if i < len(m.a) && m.removed[i] {
+			start := i
+			for i < len(m.a) && m.removed[i] {
+				i += 1
+			}
+			ops = append(ops, Op{Type: Delete, Index: units[start], Size: units[i] - units[start]})
+		} else if j < len(m.b) && m.added[j] {
+			start := j
+			for j < len(m.b) && m.added[j] {
+				j += 1
+			}
+			ops = append(ops, Op{Type: Insert, Index: units[i], Val: fromRunes(m.b[start:j])})
+		} else {
+			i += 1
+			j += 1
+		}
+	}
+	return collapse(ops)
+}
+
+// state of a single MyersDiff. removed and added mark which characters of a
+// and b are not part of the longest common subsequence found.
+type myers struct {
+	a       []rune
+	b       []rune
+	removed []bool
+	added   []bool
+}
+
+// marks the differences between a[aLo:aHi] and b[bLo:bHi] by splitting both
+// at a point on a shortest edit path and recursing on either side of it.
+func (m *myers) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && m.a[aLo] == m.b[bLo] {
+		aLo += 1
+		bLo += 1
+	}
+	for aLo < aHi && bLo < bHi && m.a[aHi-1] == m.b[bHi-1] {
+		aHi -= 1
+		bHi -= 1
+	}
+	if aLo == aHi {
+		for j := bLo; j < bHi; j++ {
+			m.added[j] = true
+		}
+		return
+	}
+	if bLo == bHi {
+		for i := aLo; i < aHi; i++ {
+			m.removed[i] = true
+		}
+		return
+	}
+	x, y := m.middleSnake(aLo, aHi, bLo, bHi)
+	m.compare(aLo, x, bLo, y)
+	m.compare(x, aHi, y, bHi)
+}
+
+// searches for a shortest edit path from both ends at once and returns the
+// point where the two searches meet. the ranges must be non-empty and differ
+// at both ends, so the point is never one of the corners and each side of it
+// needs strictly fewer edits than the whole.
+func (m *myers) middleSnake(aLo, aHi, bLo, bHi int) (int, int) {
+	n := aHi - aLo
+	mm := bHi - bLo
+	max := (n + mm + 1) / 2
+	offset := max + 1
+
+	// vf[offset+k] is the furthest x reached going forward on diagonal k = x-y.
+	// vb is the same going backward, in coordinates measured from the ends.
+	vf := make([]int, 2*max+3)
+	vb := make([]int, 2*max+3)
+	delta := n - mm
+	odd := delta%2 != 0
+
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[offset+k-1] < vf[offset+k+1]) {
+				x = vf[offset+k+1]
+			} else {
+				x = vf[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < mm && m.a[aLo+x] == m.b[bLo+y] {
+				x += 1
+				y += 1
+			}
+			vf[offset+k] = x
+
+			// the backward search on the matching diagonal has made d-1 steps
+			if kb := delta - k; odd && kb >= -(d-1) && kb <= d-1 && x+vb[offset+kb] >= n {
+				return aLo + x, bLo + y
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var u int
+			if k == -d || (k != d && vb[offset+k-1] < vb[offset+k+1]) {
+				u = vb[offset+k+1]
+			} else {
+				u = vb[offset+k-1] + 1
+			}
+			v := u - k
+			for u < n && v < mm && m.a[aHi-1-u] == m.b[bHi-1-v] {
+				u += 1
+				v += 1
+			}
+			vb[offset+k] = u
+
+			// the forward search on the matching diagonal has made d steps
+			if kf := delta - k; !odd && kf >= -d && kf <= d && u+vf[offset+kf] >= n {
+				return aHi - u, bHi - v
+			}
+		}
+	}
+	panic("myers: no middle snake found")
+}
@@ -0,0 +1,82 @@
+package git
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// characters random texts are made of, including astral plane characters,
+// which are two UTF-16 code units, and the null character cursors are marked
+// with
+const testAlphabet = "ab \n\x00é😀😃"
+
+// number of characters diff deletes from a and inserts
+func edits(a string, diff Diff) int {
+	text := encode(a)
+	n := 0
+	for _, op := range diff {
+		if op.Type == Insert {
+			n += len(runes(op.Val))
+		} else {
+			n += len(runes(decode(substring(text, op.Index, op.Index+op.Size))))
+		}
+	}
+	return n
+}
+
+func TestMyersDiff(t *testing.T) {
+	cases := [][2]string{
+		{"", ""},
+		{"", "abc"},
+		{"abc", ""},
+		{"abc", "abc"},
+		{"abc", "axc"},
+		{"kitten", "sitting"},
+		{"😀", "😃"},
+		{"a😀b", "a😃😀b"},
+		{"a\nb\nc\n", "a\nc\nb\n"},
+	}
+	for _, c := range cases {
+		diff := MyersDiff(c[0], c[1])
+		if out := ApplyDiff(c[0], diff); out != c[1] {
+			t.Errorf("MyersDiff(%q, %q) = %v, which gives %q", c[0], c[1], diff, out)
+		}
+	}
+}
+
+func TestMyersDiffRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for trial := 0; trial < 2000; trial++ {
+		a := RandomText(r, testAlphabet, r.Intn(20))
+		b := Mutate(r, a, testAlphabet)
+		if r.Intn(4) == 0 {
+			b = RandomText(r, testAlphabet, r.Intn(20))
+		}
+		diff := MyersDiff(a, b)
+		if err := diff.Validate(); err != nil {
+			t.Fatalf("MyersDiff(%q, %q) = %v: %v", a, b, diff, err)
+		}
+		if out := ApplyDiff(a, diff); out != b {
+			t.Fatalf("MyersDiff(%q, %q) = %v, which gives %q", a, b, diff, out)
+		}
+
+		// both find a shortest edit script, though not always the same one
+		if n, dp := edits(a, diff), edits(a, GetDiff(a, b)); n != dp {
+			t.Fatalf("MyersDiff(%q, %q) = %v makes %v edits, GetDiff only %v", a, b, diff, n, dp)
+		}
+	}
+}
+
+// GetDiff switches to MyersDiff past maxDynamicCells, which must still give a
+// correct diff
+func TestGetDiffLarge(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	a := RandomText(r, testAlphabet, 3000)
+	b := a
+	for k := 0; k < 50; k++ {
+		b = Mutate(r, b, testAlphabet)
+	}
+	if out := ApplyDiff(a, GetDiff(a, b)); out != b {
+		t.Fatalf("GetDiff of large texts does not give the new text")
+	}
+}
@@ -0,0 +1,36 @@
+package git
+
+// random texts and edits of them, like a user typing, for the randomized tests
+// of this package and the merger conformance harness.
+
+import "math/rand"
+
+// returns a text of length characters picked from alphabet
+func RandomText(r *rand.Rand, alphabet string, length int) string {
+	chars := []rune(alphabet)
+	text := make([]rune, length)
+	for i := range text {
+		text[i] = chars[r.Intn(len(chars))]
+	}
+	return string(text)
+}
+
+// applies a few random inserts of characters from alphabet, and deletes, to
+// text
+func Mutate(r *rand.Rand, text, alphabet string) string {
+	runes := []rune(text)
+	for k := r.Intn(5); k > 0; k-- {
+		at := r.Intn(len(runes) + 1)
+		if r.Intn(2) == 0 && at < len(runes) {
+			end := at + 1 + r.Intn(3)
+			if end > len(runes) {
+				end = len(runes)
+			}
+			runes = append(runes[:at], runes[end:]...)
+		} else {
+			insert := []rune(RandomText(r, alphabet, 1+r.Intn(3)))
+			runes = append(runes[:at], append(insert, runes[at:]...)...)
+		}
+	}
+	return string(runes)
+}
@@ -0,0 +1,295 @@
+package git
+
+// lone surrogates. javascript strings are sequences of UTF-16 code units, so a
+// javascript diff can insert or delete half of a surrogate pair: getDiff("😀",
+// "😃") only replaces the low surrogate, since both share the same high one.
+// Go strings hold UTF-8, which has no way to write half a pair, and
+// encoding/json turns one into U+FFFD. so that such diffs still apply here
+// exactly as they do in javascript, a lone surrogate is kept in a Go string
+// as the three bytes UTF-8 would encode its code point with (WTF-8), read
+// from and written to JSON as a \u escape, and turned back into the code unit
+// whenever a string is counted or applied in code units.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+func isSurrogate(u uint16) bool {
+	return u >= 0xd800 && u <= 0xdfff
+}
+
+func isHighSurrogate(u uint16) bool {
+	return u >= 0xd800 && u <= 0xdbff
+}
+
+func isLowSurrogate(u uint16) bool {
+	return u >= 0xdc00 && u <= 0xdfff
+}
+
+// returns the lone surrogate s starts with and its length in bytes, or false if
+// it does not start with one
+func surrogateAt(s string) (uint16, int, bool) {
+	if len(s) < 3 || s[0] != 0xed || s[1] < 0xa0 || s[1] > 0xbf || s[2]&0xc0 != 0x80 {
+		return 0, 0, false
+	}
+	return 0xd000 | uint16(s[1]&0x3f)<<6 | uint16(s[2]&0x3f), 3, true
+}
+
+// returns the code points of s. a lone surrogate is returned as its own code
+// point, even though it is not a valid one.
+func runes(s string) []rune {
+	out := make([]rune, 0, len(s))
+	for len(s) > 0 {
+		if u, n, ok := surrogateAt(s); ok {
+			out = append(out, rune(u))
+			s = s[n:]
+			continue
+		}
+		r, n := utf8.DecodeRuneInString(s)
+		out = append(out, r)
+		s = s[n:]
+	}
+	return out
+}
+
+// returns the string of code points rs, which may include lone surrogates
+func fromRunes(rs []rune) string {
+	b := make([]byte, 0, len(rs))
+	for _, r := range rs {
+		if r >= 0xd800 && r <= 0xdfff {
+			b = append(b, 0xed, byte(0x80|(r>>6)&0x3f), byte(0x80|r&0x3f))
+		} else {
+			b = utf8.AppendRune(b, r)
+		}
+	}
+	return string(b)
+}
+
+// returns the UTF-16 code units of s, including any lone surrogates
+func encode(s string) []uint16 {
+	units := make([]uint16, 0, len(s))
+	for _, r := range runes(s) {
+		if runeLen(r) == 2 {
+			r1, r2 := utf16.EncodeRune(r)
+			units = append(units, uint16(r1), uint16(r2))
+		} else {
+			units = append(units, uint16(r))
+		}
+	}
+	return units
+}
+
+// returns the string of UTF-16 code units s, keeping any lone surrogates
+func decode(s []uint16) string {
+	rs := make([]rune, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if isHighSurrogate(s[i]) && i+1 < len(s) && isLowSurrogate(s[i+1]) {
+			rs = append(rs, utf16.DecodeRune(rune(s[i]), rune(s[i+1])))
+			i += 1
+		} else {
+			rs = append(rs, rune(s[i]))
+		}
+	}
+	return fromRunes(rs)
+}
+
+// returns s as a JSON string, writing any lone surrogates as \u escapes, the
+// way javascript's JSON.stringify does
+func Quote(s string) string {
+	if utf8.ValidString(s) {
+		b, _ := json.Marshal(s)
+		return string(b)
+	}
+	quoted := []byte{'"'}
+	for len(s) > 0 {
+		if u, n, ok := surrogateAt(s); ok {
+			quoted = append(quoted, `\u`+strconv.FormatUint(uint64(u), 16)...)
+			s = s[n:]
+			continue
+		}
+		// everything up to the next lone surrogate is written as usual
+		end := 1
+		for end < len(s) {
+			if _, _, ok := surrogateAt(s[end:]); ok {
+				break
+			}
+			end += 1
+		}
+		b, _ := json.Marshal(s[:end])
+		quoted = append(quoted, b[1:len(b)-1]...)
+		s = s[end:]
+	}
+	return string(append(quoted, '"'))
+}
+
+// returns the string the JSON string data holds, keeping any lone surrogates
+// its \u escapes write, which encoding/json would replace with U+FFFD
+func Unquote(data []byte) (string, error) {
+	s := ""
+	if err := json.Unmarshal(data, &s); err != nil {
+		return "", err
+	}
+	if utf8.ValidString(s) && !containsEscapedSurrogate(data) {
+		return s, nil
+	}
+
+	// the string is valid JSON, so every escape is complete
+	units := []uint16{}
+	b := data[1 : len(data)-1]
+	for i := 0; i < len(b); {
+		if b[i] != '\\' {
+			r, n := utf8.DecodeRune(b[i:])
+			units = append(units, utf16.Encode([]rune{r})...)
+			i += n
+			continue
+		}
+		switch b[i+1] {
+		case 'u':
+			u, _ := strconv.ParseUint(string(b[i+2:i+6]), 16, 16)
+			units = append(units, uint16(u))
+			i += 6
+			continue
+		case 'b':
+			units = append(units, '\b')
+		case 'f':
+			units = append(units, '\f')
+		case 'n':
+			units = append(units, '\n')
+		case 'r':
+			units = append(units, '\r')
+		case 't':
+			units = append(units, '\t')
+		default: // one of " \ /
+			units = append(units, uint16(b[i+1]))
+		}
+		i += 2
+	}
+	return decode(units), nil
+}
+
+// reports whether the JSON string data has a \u escape of a surrogate
+func containsEscapedSurrogate(data []byte) bool {
+	for i := 0; i+5 < len(data); i++ {
+		if data[i] == '\\' && data[i+1] == '\\' {
+			i += 1
+		} else if data[i] == '\\' && data[i+1] == 'u' && (data[i+2] == 'd' || data[i+2] == 'D') {
+			if c := data[i+3] | 0x20; c >= '8' && c <= '9' || c >= 'a' && c <= 'f' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reports whether s has half of a surrogate pair without the other half
+func hasLoneSurrogate(s []uint16) bool {
+	for i := 0; i < len(s); i++ {
+		if isHighSurrogate(s[i]) && i+1 < len(s) && isLowSurrogate(s[i+1]) {
+			i += 1
+		} else if isSurrogate(s[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reports whether offset falls between the two halves of a surrogate pair of
+// text
+func splitsPair(text []uint16, offset int) bool {
+	return offset > 0 && offset < len(text) &&
+		isHighSurrogate(text[offset-1]) && isLowSurrogate(text[offset])
+}
+
+// a run of touching operations, which replaces the code units [start, end) of
+// the original text with val
+type edit struct {
+	start int
+	end   int
+	val   []uint16
+	ops   Diff
+}
+
+// returns diff, which applies to text, with every operation which inserts or
+// deletes half of a surrogate pair widened to the whole character, so it has
+// the same effect but never splits a pair. javascript diffs split pairs when
+// two astral plane characters share their first code unit, e.g. getDiff("😀",
+// "😃") only replaces the second one. operations which do not split a pair are
+// returned as they are. fails if diff is invalid, or would leave half a pair
+// in the text however it is widened.
+func Realign(text string, diff Diff) (Diff, error) {
+	if err := diff.validateOps(); err != nil {
+		return nil, err
+	}
+	t := encode(text)
+
+	// group touching operations, since an insert may carry the half of a pair
+	// whose other half the delete next to it removes
+	edits := []*edit{}
+	for _, op := range diff {
+		end := op.Index
+		if op.Type == Delete {
+			end += op.Size
+		}
+		if n := len(edits); n > 0 && edits[n-1].end == op.Index {
+			e := edits[n-1]
+			e.end = end
+			e.val = append(e.val, encode(op.Val)...)
+			e.ops = append(e.ops, op)
+		} else {
+			edits = append(edits, &edit{op.Index, end, encode(op.Val), Diff{op}})
+		}
+	}
+
+	realigned := Diff{}
+	for i := 0; i < len(edits); i++ {
+		e := edits[i]
+		if e.end > len(t) || (!splitsPair(t, e.start) && !splitsPair(t, e.end) && !hasLoneSurrogate(e.val)) {
+			realigned = append(realigned, e.ops...)
+			continue
+		}
+
+		// widen the edit to whole characters, taking in any edits it then
+		// touches, which are widened in turn
+		start, end, val := e.start, e.end, e.val
+		for {
+			if splitsPair(t, start) {
+				val = append([]uint16{t[start-1]}, val...)
+				start -= 1
+			}
+			if splitsPair(t, end) {
+				val = append(val, t[end])
+				end += 1
+			}
+			if i+1 == len(edits) || edits[i+1].start > end {
+				break
+			}
+			next := edits[i+1]
+			val = append(append(val, t[end:next.start]...), next.val...)
+			end = next.end
+			i += 1
+		}
+		if hasLoneSurrogate(val) {
+			return nil, fmt.Errorf("diff leaves half of a surrogate pair at %v", start)
+		}
+
+		// then leave out what it deletes and inserts again, a whole
+		// character at a time
+		for end > start && len(val) > 0 && t[start] == val[0] && !splitsPair(t, start+1) {
+			start, val = start+1, val[1:]
+		}
+		for end > start && len(val) > 0 && t[end-1] == val[len(val)-1] && !splitsPair(t, end-1) {
+			end, val = end-1, val[:len(val)-1]
+		}
+		if end > start {
+			realigned = append(realigned, Op{Type: Delete, Index: start, Size: end - start})
+		}
+		if len(val) > 0 {
+			realigned = append(realigned, Op{Type: Insert, Index: end, Val: decode(val)})
+		}
+	}
+	return realigned, nil
+}
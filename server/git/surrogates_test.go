@@ -0,0 +1,111 @@
+package git
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// diffs a and b a code unit at a time, the way javascript's getDiff does, so
+// the diff may split surrogate pairs
+func unitDiff(a, b string) Diff {
+	units := func(s string) string {
+		rs := []rune{}
+		for _, u := range encode(s) {
+			rs = append(rs, rune(u))
+		}
+		return fromRunes(rs)
+	}
+	return GetDiff(units(a), units(b))
+}
+
+func TestSplitDiffs(t *testing.T) {
+	// javascript's getDiff("😀", "😃") only replaces the second code unit
+	var diff Diff
+	data := `[{"type":"Delete","index":1,"size":1},{"type":"Insert","index":2,"val":"\ude03"}]`
+	if err := json.Unmarshal([]byte(data), &diff); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diff, unitDiff("😀", "😃")) {
+		t.Fatalf("%v is not the javascript diff, %v", unitDiff("😀", "😃"), diff)
+	}
+	if out := ApplyDiff("😀", diff); out != "😃" {
+		t.Fatalf("applying %v to 😀 gives %q", diff, out)
+	}
+	if b, _ := json.Marshal(diff); string(b) != data {
+		t.Fatalf("%v is written as %s", diff, b)
+	}
+	if diff.Validate() == nil {
+		t.Fatalf("%v passes Validate", diff)
+	}
+
+	realigned, err := Realign("😀", diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Diff{{Type: Delete, Index: 0, Size: 2}, {Type: Insert, Index: 2, Val: "😃"}}
+	if !reflect.DeepEqual(realigned, want) {
+		t.Fatalf("Realign(😀, %v) = %v, not %v", diff, realigned, want)
+	}
+}
+
+func TestRealign(t *testing.T) {
+	// ops which split no pair are left alone
+	diff := Diff{{Type: Delete, Index: 1, Size: 2}, {Type: Insert, Index: 4, Val: "x"}}
+	if realigned, err := Realign("a😀b", diff); err != nil || !reflect.DeepEqual(realigned, diff) {
+		t.Fatalf("Realign(a😀b, %v) = %v, %v", diff, realigned, err)
+	}
+
+	// half a pair which the text does not complete cannot be realigned
+	diff = Diff{{Type: Insert, Index: 1, Val: decode([]uint16{0xd83d})}}
+	if _, err := Realign("ab", diff); err == nil {
+		t.Fatalf("Realign(ab, %v) leaves half a pair", diff)
+	}
+
+	r := rand.New(rand.NewSource(4))
+	for trial := 0; trial < 2000; trial++ {
+		a := RandomText(r, testAlphabet, r.Intn(12))
+		b := Mutate(r, a, testAlphabet)
+		diff := unitDiff(a, b)
+		if out := ApplyDiff(a, diff); out != b {
+			t.Fatalf("unitDiff(%q, %q) = %v, which gives %q", a, b, diff, out)
+		}
+		realigned, err := Realign(a, diff)
+		if err != nil {
+			t.Fatalf("Realign(%q, %v): %v", a, diff, err)
+		}
+		if err := realigned.Validate(); err != nil {
+			t.Fatalf("Realign(%q, %v) = %v: %v", a, diff, realigned, err)
+		}
+		if out := ApplyDiff(a, realigned); out != b {
+			t.Fatalf("Realign(%q, %v) = %v, which gives %q, not %q", a, diff, realigned, out, b)
+		}
+		text := encode(a)
+		for _, op := range realigned {
+			if splitsPair(text, op.Index) || splitsPair(text, op.Index+op.Size) {
+				t.Fatalf("Realign(%q, %v) = %v, which still splits a pair", a, diff, realigned)
+			}
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, data := range []string{`""`, `"a\"\\\/\n\t"`, `"😀"`, `"\ud83d"`, `"a\ude03b😀"`} {
+		s, err := Unquote([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain := ""
+		json.Unmarshal([]byte(data), &plain)
+		if back := ""; json.Unmarshal([]byte(Quote(s)), &back) != nil || back != plain {
+			t.Fatalf("Quote(Unquote(%s)) = %s", data, Quote(s))
+		}
+		if again, _ := Unquote([]byte(Quote(s))); again != s {
+			t.Fatalf("Unquote(Quote(%q)) = %q", s, again)
+		}
+	}
+	if s, _ := Unquote([]byte(`"\ude03"`)); !reflect.DeepEqual(encode(s), []uint16{0xde03}) {
+		t.Fatalf("Unquote replaced half a pair with %q", s)
+	}
+}
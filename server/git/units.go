@@ -0,0 +1,119 @@
+package git
+
+// conversion of diffs between index units. diffs made by javascript, and every
+// diff the pad server stores, count UTF-16 code units. a Go client naturally
+// counts bytes or runes instead, which disagree as soon as the text holds
+// anything outside ASCII: "é" is 1 unit, 1 rune and 2 bytes, "😀" is 2 units,
+// 1 rune and 4 bytes. a combining mark such as the accent in "é" is a
+// rune of its own, so it can be inserted or deleted separately from its base.
+
+import "fmt"
+
+const (
+	UTF16 = "utf16" // UTF-16 code units, as javascript strings count
+	Runes = "rune"  // unicode code points
+	Bytes = "byte"  // bytes of the UTF-8 encoding, as Go strings count
+)
+
+// reports whether unit is one a diff's indexes can be counted in. "" means
+// UTF16.
+func KnownUnit(unit string) bool {
+	return unit == "" || unit == UTF16 || unit == Runes || unit == Bytes
+}
+
+// reports whether indexes counted in units a and b agree
+func SameUnit(a, b string) bool {
+	if a == "" {
+		a = UTF16
+	}
+	if b == "" {
+		b = UTF16
+	}
+	return a == b
+}
+
+// offsets of every character boundary of a text in each unit, so an index can
+// be looked up in one unit and read off in another.
+type boundaries struct {
+	offsets map[string][]int       // by unit, offset of each boundary
+	index   map[string]map[int]int // by unit, boundary at each offset
+}
+
+func findBoundaries(text string) *boundaries {
+	b := &boundaries{map[string][]int{}, map[string]map[int]int{}}
+	u, r := 0, 0
+	for i, c := range text {
+		b.offsets[UTF16] = append(b.offsets[UTF16], u)
+		b.offsets[Runes] = append(b.offsets[Runes], r)
+		b.offsets[Bytes] = append(b.offsets[Bytes], i)
+		u += runeLen(c)
+		r += 1
+	}
+	b.offsets[UTF16] = append(b.offsets[UTF16], u)
+	b.offsets[Runes] = append(b.offsets[Runes], r)
+	b.offsets[Bytes] = append(b.offsets[Bytes], len(text))
+	for unit, offsets := range b.offsets {
+		b.index[unit] = make(map[int]int, len(offsets))
+		for k, offset := range offsets {
+			b.index[unit][offset] = k
+		}
+	}
+	return b
+}
+
+// converts offset from one unit to another. it must fall on a character
+// boundary of the text, never inside one.
+func (b *boundaries) convert(offset int, from, to string) (int, error) {
+	k, ok := b.index[from][offset]
+	if !ok {
+		return 0, fmt.Errorf("%v offset %v is not a character boundary of the text", from, offset)
+	}
+	return b.offsets[to][k], nil
+}
+
+// returns diff with its indexes and sizes converted from one unit to another,
+// given the text it applies to. "" means UTF16 for either unit. fails if the
+// diff indexes past the end of the text or into the middle of a character.
+func ConvertDiff(text string, diff Diff, from, to string) (Diff, error) {
+	if !KnownUnit(from) || !KnownUnit(to) {
+		return nil, fmt.Errorf("cannot convert %q indexes to %q", from, to)
+	}
+	if SameUnit(from, to) {
+		return diff, nil
+	}
+	if from == "" {
+		from = UTF16
+	}
+	if to == "" {
+		to = UTF16
+	}
+	b := findBoundaries(text)
+	converted := make(Diff, len(diff))
+	for i, op := range diff {
+		index, err := b.convert(op.Index, from, to)
+		if err != nil {
+			return nil, err
+		}
+		converted[i] = op
+		converted[i].Index = index
+		if op.Type == Delete {
+			end, err := b.convert(op.Index+op.Size, from, to)
+			if err != nil {
+				return nil, err
+			}
+			converted[i].Size = end - index
+		}
+	}
+	return converted, nil
+}
+
+// returns the length of s counted in unit
+func LenIn(s string, unit string) int {
+	switch unit {
+	case Runes:
+		return len(runes(s))
+	case Bytes:
+		return len(s)
+	}
+	return Len(s)
+}
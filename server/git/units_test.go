@@ -0,0 +1,65 @@
+package git
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConvertDiff(t *testing.T) {
+	// the same diff of each text, counted in each unit
+	cases := []struct {
+		text  string
+		lens  map[string]int
+		diffs map[string]Diff
+	}{
+		{"😀", map[string]int{UTF16: 2, Runes: 1, Bytes: 4}, map[string]Diff{
+			UTF16: {{Type: Delete, Index: 0, Size: 2}, {Type: Insert, Index: 2, Val: "x"}},
+			Runes: {{Type: Delete, Index: 0, Size: 1}, {Type: Insert, Index: 1, Val: "x"}},
+			Bytes: {{Type: Delete, Index: 0, Size: 4}, {Type: Insert, Index: 4, Val: "x"}},
+		}},
+		// the accent is a character of its own, which can be deleted alone
+		{"e\u0301", map[string]int{UTF16: 2, Runes: 2, Bytes: 3}, map[string]Diff{
+			UTF16: {{Type: Delete, Index: 1, Size: 1}, {Type: Insert, Index: 2, Val: "!"}},
+			Runes: {{Type: Delete, Index: 1, Size: 1}, {Type: Insert, Index: 2, Val: "!"}},
+			Bytes: {{Type: Delete, Index: 1, Size: 2}, {Type: Insert, Index: 3, Val: "!"}},
+		}},
+	}
+	for _, c := range cases {
+		for from, diff := range c.diffs {
+			if n := LenIn(c.text, from); n != c.lens[from] {
+				t.Errorf("LenIn(%q, %v) = %v, not %v", c.text, from, n, c.lens[from])
+			}
+			for to, want := range c.diffs {
+				converted, err := ConvertDiff(c.text, diff, from, to)
+				if err != nil {
+					t.Fatalf("ConvertDiff(%q, %v, %v, %v): %v", c.text, diff, from, to, err)
+				}
+				if !reflect.DeepEqual(converted, want) {
+					t.Errorf("ConvertDiff(%q, %v, %v, %v) = %v, not %v", c.text, diff, from, to, converted, want)
+				}
+			}
+		}
+		if n := LenIn(c.text, ""); n != c.lens[UTF16] {
+			t.Errorf("LenIn(%q, \"\") = %v, not %v", c.text, n, c.lens[UTF16])
+		}
+	}
+
+	// indexes inside a character, including between the halves of a
+	// surrogate pair, or past the end of the text cannot be converted
+	bad := []struct {
+		text     string
+		diff     Diff
+		from, to string
+	}{
+		{"😀", Diff{{Type: Insert, Index: 1, Val: "x"}}, UTF16, Runes},
+		{"😀", Diff{{Type: Delete, Index: 0, Size: 1}}, UTF16, Bytes},
+		{"😀", Diff{{Type: Insert, Index: 2, Val: "x"}}, Bytes, UTF16},
+		{"e\u0301", Diff{{Type: Delete, Index: 1, Size: 1}}, Bytes, Runes},
+		{"e\u0301", Diff{{Type: Insert, Index: 3, Val: "x"}}, Runes, ""},
+	}
+	for _, c := range bad {
+		if converted, err := ConvertDiff(c.text, c.diff, c.from, c.to); err == nil {
+			t.Errorf("ConvertDiff(%q, %v, %v, %v) = %v", c.text, c.diff, c.from, c.to, converted)
+		}
+	}
+}
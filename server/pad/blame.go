@@ -0,0 +1,128 @@
+package pad
+
+// keeps track of who wrote each character of a doc. a doc's blame is a list of
+// spans covering its text in order, each saying which commit inserted that run
+// of text. it is updated with each commit's diff as the commit is put, exactly
+// as the text is, and rebuilt from the commits when a doc is loaded or synced,
+// starting from the blame as of the doc's base once it has been compacted.
+//
+// /blame replies with the spans of a doc's current text as JSON, e.g.
+//
+//   {"head":4,"spans":[{"text":"hello ","commit":1,"clientID":3},{"text":"world","commit":4,"clientID":7}]}
+
+import (
+	"../git"
+	"encoding/json"
+	"net/http"
+	"unicode/utf16"
+)
+
+// a run of text inserted by a single commit. length counts UTF-16 code units,
+// as diffs do. fields are exported so docs' base blame can be synced.
+type blameSpan struct {
+	Length   int
+	Commit   int
+	ClientID int
+}
+
+type BlameSpan struct {
+	Text     string `json:"text"`
+	Commit   int    `json:"commit"`
+	ClientID int    `json:"clientID"`
+}
+
+type Blame struct {
+	Head  int         `json:"head"`
+	Spans []BlameSpan `json:"spans"`
+}
+
+// returns the spans of the text which results from applying diff, made by
+// the given commit, to the text spans cover
+func applyBlame(spans []blameSpan, diff git.Diff, commit, clientID int) []blameSpan {
+	out := []blameSpan{}
+	push := func(s blameSpan) {
+		if s.Length == 0 {
+			return
+		}
+		if n := len(out); n > 0 && out[n-1].Commit == s.Commit {
+			out[n-1].Length += s.Length
+		} else {
+			out = append(out, s)
+		}
+	}
+
+	// walks spans, copying or skipping n code units at a time
+	k, offset := 0, 0
+	walk := func(n int, keep bool) {
+		for n > 0 && k < len(spans) {
+			s := spans[k]
+			take := s.Length - offset
+			if take > n {
+				take = n
+			}
+			if keep {
+				push(blameSpan{take, s.Commit, s.ClientID})
+			}
+			n -= take
+			offset += take
+			if offset == s.Length {
+				k, offset = k+1, 0
+			}
+		}
+	}
+
+	pos := 0
+	for _, op := range diff {
+		walk(op.Index-pos, true)
+		pos = op.Index
+		if op.Type == git.Insert {
+			push(blameSpan{git.Len(op.Val), commit, clientID})
+		} else if op.Type == git.Delete {
+			walk(op.Size, false)
+			pos += op.Size
+		}
+	}
+	for k < len(spans) {
+		walk(spans[k].Length-offset, true)
+	}
+	return out
+}
+
+// brings the doc's blame up to date with every commit put so far. the caller
+// must hold doc.mu.
+func (doc *Doc) updateBlame() {
+	if doc.blamed < doc.base {
+		doc.blame, doc.blamed = doc.baseBlame, doc.base
+	}
+	for doc.blamed < doc.head() {
+		doc.blamed += 1
+		c := doc.commit(doc.blamed)
+		doc.blame = applyBlame(doc.blame, c.Diff, doc.blamed, c.ClientID)
+	}
+}
+
+// returns the doc's blame for its current text
+func (doc *Doc) getBlame() Blame {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	doc.updateBlame()
+	text := utf16.Encode([]rune(unquote(doc.text)))
+	blame := Blame{Head: doc.head(), Spans: []BlameSpan{}}
+	start := 0
+	for _, s := range doc.blame {
+		end := start + s.Length
+		if end > len(text) {
+			end = len(text)
+		}
+		blame.Spans = append(blame.Spans, BlameSpan{string(utf16.Decode(text[start:end])), s.Commit, s.ClientID})
+		start = end
+	}
+	return blame
+}
+
+func (ps *PadServer) blameHandler(w http.ResponseWriter, r *http.Request) {
+	doc := ps.getDoc(r.Header.Get("doc-id"))
+	b, _ := json.Marshal(doc.getBlame())
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
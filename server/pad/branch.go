@@ -0,0 +1,198 @@
+package pad
+
+// branching of docs. forking a doc makes a new doc with the same history as the
+// original up to a chosen commit, after which the two are edited independently.
+//
+// /fork is asked to fork with headers:
+//
+//   doc-id      the doc to fork
+//   fork-id     the new doc, which must not have any commits yet
+//   at-commit   the commit to fork at, head if absent
+//
+// and replies like /init does for the new doc once every peer has forked it.
+//
+// merging a fork puts everything committed to it since the fork onto the doc it
+// was forked from, as a single commit rebased like any other. the fork is then
+// closed: it can still be edited but not merged again. /merge is asked to
+// merge the fork given by the doc-id header, on behalf of the client given by
+// client-id, and replies with the commit the merge put, whose conflicts say
+// what of the fork could not be kept.
+
+import (
+	"../git"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// creates doc docID as a copy of source as of commit at. fails with a
+// MalformedError if docID was not created or already has commits of its own,
+// or source does not exist or has no commit at, a GoneError if at was compacted and a
+// DeletedError if either doc was deleted.
+func (ps *PadServer) fork(docID, source string, at int) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if docID == source {
+		return &MalformedError{fmt.Sprintf("cannot fork %q into itself", source)}
+	} else if ps.tombstones[docID] {
+		return &DeletedError{docID}
+	}
+	src, err := ps.find(source)
+	if err != nil {
+		return err
+	}
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if at > src.head() || at < 0 {
+		return &MalformedError{fmt.Sprintf("commit %v is not between 0 and head %v", at, src.head())}
+	}
+	text, err := src.textAt(at, ps.merger)
+	if err != nil {
+		return err
+	}
+
+	// docs are created on each peer as soon as they are looked at, so only
+	// commits tell whether a doc is in use
+	doc, ok := ps.docs[docID]
+	if !ok {
+		doc = ps.NewDoc(docID)
+	}
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if err := doc.created(); err != nil {
+		return err
+	} else if doc.head() > 0 {
+		return &MalformedError{fmt.Sprintf("%q already has commits", docID)}
+	}
+
+	doc.commits = append([]Commit{}, src.commits[:at-src.base+1]...)
+	doc.text = text
+	doc.mode = src.mode
+	doc.base = src.base
+	doc.baseText = src.baseText
+	doc.baseBlame = src.baseBlame
+	doc.origin = source
+	doc.forkPoint = at
+	for _, s := range src.snapshots {
+		if s.index <= at {
+			doc.snapshots = append(doc.snapshots, s)
+		}
+	}
+	doc.squashes = nil
+	doc.blame, doc.blamed = nil, 0
+	ps.docs[docID] = doc
+
+	// anyone already waiting for the doc's first commit can have it now
+	if at > doc.base {
+		for _, c := range doc.listeners {
+			c <- doc.commit(doc.base + 1)
+		}
+		doc.listeners = make([]chan Commit, 0)
+	}
+	return nil
+}
+
+// puts the commits made on the fork args.DocId since it was forked onto its
+// origin as one commit, and returns that commit as put, with any conflicts.
+// fails with a MalformedError if the doc does not exist, is not an open fork
+// or nothing was committed to it, and a GoneError if either doc was compacted
+// past the fork. proposed is when the merge was proposed, in Unix nanoseconds.
+func (ps *PadServer) merge(args MergeArgs, proposed int64) (Commit, error) {
+	fork, err := ps.lookup(args.DocId)
+	if err != nil {
+		return Commit{}, err
+	}
+	fork.mu.Lock()
+	origin, at, head := fork.origin, fork.forkPoint, fork.head()
+	fork.mu.Unlock()
+	if origin == "" {
+		return Commit{}, &MalformedError{fmt.Sprintf("%q is not a fork, or was already merged", args.DocId)}
+	} else if head == at {
+		return Commit{}, &MalformedError{fmt.Sprintf("nothing was committed to %q since it was forked", args.DocId)}
+	}
+
+	// squash the fork's commits into one, with the fork point as its parent,
+	// which is the same commit on the origin
+	var squash Commit
+	if composer, ok := ps.merger.(Composer); ok {
+		squash, err = fork.getSquash(at, head, composer)
+	} else {
+		var text string
+		if text, err = fork.getTextAt(at, ps.merger); err == nil {
+			_, forkText := fork.getState()
+			if squash.Diff, err = ps.merger.GetDiff(text, forkText); err == nil {
+				squash.Diff, err = git.Realign(unquote(text), squash.Diff)
+			}
+		}
+	}
+	if err != nil {
+		return Commit{}, err
+	}
+	commit := MakeCommit(args.ClientID, at, squash.Diff, args.ID)
+	commit.Proposed = proposed
+
+	if err := ps.put(commit, origin, ""); err != nil {
+		return Commit{}, err
+	}
+	ps.dups[commitKey{origin, commit.ClientID, commit.ID}] = true
+	fork.mu.Lock()
+	fork.origin = ""
+	fork.mu.Unlock()
+
+	doc, err := ps.lookup(origin)
+	if err != nil {
+		return Commit{}, err
+	}
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	return doc.commit(doc.head()), nil
+}
+
+func (ps *PadServer) forkHandler(w http.ResponseWriter, r *http.Request) {
+	source := r.Header.Get("doc-id")
+	docID := r.Header.Get("fork-id")
+	if docID == "" || docID == source {
+		http.Error(w, "fork-id must name a new doc", http.StatusBadRequest)
+		return
+	}
+	_, at := ps.getDoc(source).getBounds()
+	if h := r.Header.Get("at-commit"); h != "" {
+		var err error
+		if at, err = strconv.Atoi(h); err != nil {
+			http.Error(w, fmt.Sprintf("invalid commit %q", h), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := ps.create(docID); err != nil {
+		mergerError(w, err)
+		return
+	}
+	args := ForkArgs{docID, source, at}
+	if _, err := ps.proposeAndWait(makeOp(FORK, args)); err != nil {
+		mergerError(w, err)
+		return
+	}
+	head, text := ps.getDoc(docID).getState()
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Add("head", strconv.Itoa(head))
+	w.Write([]byte(text))
+}
+
+func (ps *PadServer) mergeHandler(w http.ResponseWriter, r *http.Request) {
+	docID := r.Header.Get("doc-id")
+	clientID, _ := strconv.Atoi(r.Header.Get("client-id"))
+	fork := ps.getDoc(docID)
+	fork.mu.Lock()
+	origin := fork.origin
+	fork.mu.Unlock()
+
+	args := MergeArgs{docID, clientID, nrand()}
+	commit, err := ps.proposeAndWait(makeOp(MERGE, args))
+	if err != nil {
+		mergerError(w, err)
+		return
+	}
+	w.Header().Add("head", strconv.Itoa(commit.Parent+1))
+	ps.writeCommit(w, r, ps.getDoc(origin), commit)
+}
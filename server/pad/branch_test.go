@@ -0,0 +1,104 @@
+package pad
+
+import (
+	"../git"
+	"strings"
+	"testing"
+)
+
+func TestForkAt(t *testing.T) {
+	ps := testServer(t)
+	edit(t, ps, "draft", "one")
+	edit(t, ps, "draft", "one two")
+	edit(t, ps, "draft", "one two three")
+
+	// a fork is a copy of its source as of the given commit, with the same
+	// commits up to it
+	if _, err := run(ps, makeOp(CREATE, CreateArgs{"copy", nrand()})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(ps, makeOp(FORK, ForkArgs{"copy", "draft", 2})); err != nil {
+		t.Fatal(err)
+	}
+	expectText(t, ps, "copy", 2, "one two")
+	fork, draft := ps.getDoc("copy"), ps.getDoc("draft")
+	for i := 1; i <= 2; i++ {
+		if fork.commit(i).ID != draft.commit(i).ID {
+			t.Fatalf("commit %v of the fork is %v, not %v", i, fork.commit(i), draft.commit(i))
+		}
+	}
+	if fork.origin != "draft" || fork.forkPoint != 2 {
+		t.Fatalf("fork of %q at %v, not of draft at 2", fork.origin, fork.forkPoint)
+	}
+
+	// from then on they are separate docs
+	edit(t, ps, "copy", "one two four")
+	edit(t, ps, "draft", "zero one two three")
+	expectText(t, ps, "copy", 3, "one two four")
+	expectText(t, ps, "draft", 4, "zero one two three")
+
+	// docs which already have commits cannot be forked into, and only
+	// commits the source has can be forked at
+	if _, err := run(ps, makeOp(FORK, ForkArgs{"copy", "draft", 1})); err == nil {
+		t.Fatal("forked into a doc with commits")
+	}
+	if _, err := run(ps, makeOp(CREATE, CreateArgs{"late", nrand()})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(ps, makeOp(FORK, ForkArgs{"late", "draft", 5})); err == nil {
+		t.Fatal("forked at a commit past the source's head")
+	}
+	if _, err := run(ps, makeOp(FORK, ForkArgs{"never", "draft", 1})); err == nil {
+		t.Fatal("forked into a doc which was never created")
+	}
+
+	// nor can docs which do not exist be forked, which must not leave a
+	// placeholder for them behind
+	if _, err := run(ps, makeOp(FORK, ForkArgs{"late", "nowhere", 0})); err == nil {
+		t.Fatal("forked a doc which does not exist")
+	} else if _, ok := ps.docs["nowhere"]; ok {
+		t.Fatal("forking a doc which does not exist made a placeholder for it")
+	}
+}
+
+func TestMergeConflicts(t *testing.T) {
+	ps := testServer(t)
+	edit(t, ps, "draft", "one two three")
+	if _, err := run(ps, makeOp(CREATE, CreateArgs{"copy", nrand()})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(ps, makeOp(FORK, ForkArgs{"copy", "draft", 1})); err != nil {
+		t.Fatal(err)
+	}
+
+	// the fork rewrites a word which the origin deletes meanwhile, so the
+	// fork's commits are squashed and rebased over the deletion with conflicts
+	edit(t, ps, "copy", "one TWO three")
+	edit(t, ps, "copy", "one TWO three four")
+	edit(t, ps, "draft", "one three")
+	_, before := ps.getDoc("draft").getState()
+	merged, err := run(ps, makeOp(MERGE, MergeArgs{"copy", 7, 42}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Parent != 2 || merged.ClientID != 7 || merged.ID != 42 || len(merged.Conflicts) == 0 {
+		t.Fatalf("merge put %v", merged)
+	}
+	expectText(t, ps, "draft", 3, git.ApplyDiff(unquote(before), merged.Diff))
+	if _, text := ps.getDoc("draft").getState(); !strings.HasSuffix(unquote(text), " four") {
+		t.Fatalf("merge lost the fork's last commit: %q", unquote(text))
+	}
+
+	// a fork is merged once, and only docs which exist can be merged
+	if _, err := run(ps, makeOp(MERGE, MergeArgs{"copy", 7, 43})); err == nil {
+		t.Fatal("merged a fork twice")
+	}
+	if _, err := run(ps, makeOp(MERGE, MergeArgs{"nowhere", 7, 44})); err == nil {
+		t.Fatal("merged a doc which does not exist")
+	} else if _, ok := err.(*MalformedError); !ok {
+		t.Fatalf("merging a doc which does not exist failed with %v", err)
+	}
+	if _, ok := ps.docs["nowhere"]; ok {
+		t.Fatal("merging a doc which does not exist made a placeholder for it")
+	}
+}
@@ -1,47 +1,275 @@
 package pad
 
-// defines functionality to essentially make RPC calls to locally running node
-// server to rebase incoming commits and update the current state of the
-// document.
+// defines the Mergers a PadServer can use to rebase incoming commits and update
+// the current state of the document. NativeMerger runs the git package, a Go
+// port of the javascript the clients use. NodeMerger essentially makes RPC
+// calls to a locally running node server, git-server.js, which runs the
+// javascript itself.
 
 import (
+	"../git"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strconv"
 	"strings"
+	"time"
 )
 
-// these next three functions are exactly what we want
+const (
+	NODETIMEOUT = 2 * time.Second        // per request to the node server
+	NODERETRIES = 4                      // attempts after the first one fails
+	NODEBACKOFF = 100 * time.Millisecond // wait before the first retry, doubled after
+)
+
+// Merger performs the three git operations a PadServer needs. texts are passed
+// around JSON-ified, exactly as they are served to clients. an error means the
+// operation could not be performed right now; a MalformedError means it never
+// can be.
+type Merger interface {
+	// returns diff from text a to text b
+	GetDiff(a, b string) (git.Diff, error)
+	// returns commit c2 rebased over commit c1. may list the parts of c2 it
+	// could not keep in the rebased commit's conflicts.
+	Rebase(c1, c2 Commit) (Commit, error)
+	// returns JSON-ified application of commit.diff to text
+	ApplyDiff(text string, commit Commit) (string, error)
+}
+
+// Composer is implemented by Mergers which can squash consecutive commits into
+// one, so a client can catch up on all of them, or a fork be merged, in a
+// single step.
+type Composer interface {
+	// returns commit with the effect of c1 followed by c2
+	Compose(c1, c2 Commit) (Commit, error)
+}
+
+// MalformedError is returned by a Merger given a commit or text it cannot make
+// sense of. retrying will not help, so whatever it came from should be dropped.
+type MalformedError struct {
+	Reason string
+}
+
+func (e *MalformedError) Error() string {
+	return "malformed input: " + e.Reason
+}
+
+// NATIVE
+
+type NativeMerger struct{}
+
+func MakeNativeMerger() *NativeMerger {
+	return &NativeMerger{}
+}
+
+func (nm *NativeMerger) GetDiff(a, b string) (git.Diff, error) {
+	textA, err := decodeText(a)
+	if err != nil {
+		return nil, err
+	}
+	textB, err := decodeText(b)
+	if err != nil {
+		return nil, err
+	}
+	return git.GetDiff(textA, textB), nil
+}
+
+func (nm *NativeMerger) Rebase(c1, c2 Commit) (Commit, error) {
+	if err := requireUTF16(c1, c2); err != nil {
+		return Commit{}, err
+	}
+	rebased := c2
+	var conflicts []git.Conflict
+	rebased.Diff, conflicts = git.RebaseConflicts(c1.Diff, c2.Diff)
+	rebased.Parent = c2.Parent + 1
+
+	// record what was lost alongside the commit, along with the commits it was
+	// rebased over. c1 is either a single commit or a squash up to its head.
+	if len(conflicts) > 0 {
+		from := c1.Parent + 1
+		to := from
+		if c1.Head > from {
+			to = c1.Head
+		}
+		rebased.Conflicts = append([]Conflict{}, c2.Conflicts...)
+		for _, c := range conflicts {
+			rebased.Conflicts = append(rebased.Conflicts, Conflict{c, from, to})
+		}
+	}
+	return rebased, nil
+}
+
+// returns a commit with the same parent as c1 whose diff has the effect of c1
+// followed by c2. rebasing over it may resolve overlapping edits differently
+// than rebasing over c1 and c2 one at a time, so stale commits are never
+// rebased over one. the squash's head is the index of c2.
+func (nm *NativeMerger) Compose(c1, c2 Commit) (Commit, error) {
+	if err := requireUTF16(c1, c2); err != nil {
+		return Commit{}, err
+	}
+	squash := Commit{}
+	squash.Parent = c1.Parent
+	squash.Head = c2.Parent + 1
+	diff, err := git.Compose(c1.Diff, c2.Diff)
+	if err != nil {
+		return Commit{}, &MalformedError{err.Error()}
+	}
+	squash.Diff = diff
+	return squash, nil
+}
+
+func (nm *NativeMerger) ApplyDiff(text string, commit Commit) (string, error) {
+	s, err := decodeText(text)
+	if err != nil {
+		return "", err
+	}
+	commit, err = ConvertCommit(text, commit, git.UTF16)
+	if err != nil {
+		return "", err
+	}
+	return git.Quote(git.ApplyDiff(s, commit.Diff)), nil
+}
 
-// returns JSON-ified diff
-func (ps *PadServer) getDiff(a, b string) string {
+// NODE
+
+// NodeMerger keeps connections to the node server open between calls, gives
+// up on a call after NODETIMEOUT and retries failed calls with exponential
+// backoff before reporting an error.
+type NodeMerger struct {
+	port   string
+	client *http.Client
+}
+
+// port is the port git-server.js is listening on.
+func MakeNodeMerger(port string) *NodeMerger {
+	nm := &NodeMerger{}
+	nm.port = port
+	nm.client = &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: 16},
+		Timeout:   NODETIMEOUT,
+	}
+	return nm
+}
+
+func (nm *NodeMerger) GetDiff(a, b string) (git.Diff, error) {
 	url := "/getDiff"
 	body := fmt.Sprintf("{\"a\":%v, \"b\":%v}", a, b)
-	return ps.hitNode(url, body)
+	diff := git.Diff{}
+	text, err := nm.hitNode(url, body)
+	if err == nil {
+		err = answer(text, &diff)
+	}
+	return diff, err
 }
 
-// returns JSON-ified rebased commit c2 over commit c1
-func (ps *PadServer) rebase(c1, c2 Commit) Commit {
+func (nm *NodeMerger) Rebase(c1, c2 Commit) (Commit, error) {
+	if err := requireUTF16(c1, c2); err != nil {
+		return Commit{}, err
+	}
 	url := "/rebase"
 	body := fmt.Sprintf("{\"c1\": %v, \"c2\": %v}", c1, c2)
-	return Commit(ps.hitNode(url, string(body)))
+	rebased := Commit{}
+	text, err := nm.hitNode(url, body)
+	if err == nil {
+		err = answer(text, &rebased)
+	}
+	return rebased, err
 }
 
-// returns JSON-ified application of commit.diff to text
-func (ps *PadServer) applyDiff(text string, commit Commit) string {
+// the javascript only counts UTF-16 code units, so commits are converted first
+func (nm *NodeMerger) ApplyDiff(text string, commit Commit) (string, error) {
+	commit, err := ConvertCommit(text, commit, git.UTF16)
+	if err != nil {
+		return "", err
+	}
 	url := "/applyDiff"
 	body := fmt.Sprintf("{\"text\":%v, \"commit\": %v}", text, commit)
-	return ps.hitNode(url, body)
+	return nm.hitNode(url, body)
 }
 
-// handles http communication with the server
-func (ps *PadServer) hitNode(url, strBody string) string {
+// checks the node server is up and answering, without retrying
+func (nm *NodeMerger) ping() error {
+	_, err := nm.post("/health", "{}")
+	return err
+}
+
+// handles http communication with the server, retrying until it answers
+func (nm *NodeMerger) hitNode(url, strBody string) (string, error) {
+	backoff := NODEBACKOFF
+	text, err := nm.post(url, strBody)
+	for retry := 0; retry < NODERETRIES && err != nil; retry++ {
+		if _, ok := err.(*MalformedError); ok {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		text, err = nm.post(url, strBody)
+	}
+	return text, err
+}
+
+func (nm *NodeMerger) post(url, strBody string) (string, error) {
 	body := strings.NewReader(strBody)
-	nodePortNum, _ := strconv.Atoi(ps.port)
-	nodePortStr := strconv.Itoa(nodePortNum - 2000)
-	res, _ := http.Post("http://localhost:"+nodePortStr+url, "application/json", body)
-	rawText, _ := ioutil.ReadAll(res.Body)
+	res, err := nm.client.Post("http://localhost:"+nm.port+url, "application/json", body)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	rawText, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
 	text := string(rawText)
-	return text
+	if res.StatusCode == http.StatusBadRequest {
+		// the node server could not parse what it was given
+		return "", &MalformedError{strings.TrimSpace(text)}
+	} else if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("node server %v: %v", url, res.Status)
+	}
+	return text, nil
+}
+
+// documents' text is kept JSON-ified, exactly as it is served to clients.
+// javascript may leave half of a surrogate pair in it, which is kept.
+func unquote(text string) string {
+	s, _ := git.Unquote([]byte(text))
+	return s
+}
+
+// unquotes JSON-ified text, describing any failure as a MalformedError
+func decodeText(text string) (string, error) {
+	s, err := git.Unquote([]byte(text))
+	if err != nil {
+		return "", &MalformedError{err.Error()}
+	}
+	return s, nil
+}
+
+// unmarshals JSON data into v, describing any failure as a MalformedError
+func decode(data string, v interface{}) error {
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		return &MalformedError{err.Error()}
+	}
+	return nil
+}
+
+// unmarshals a JSON answer from a merge helper into v. the helper was given
+// valid input, so an answer which does not parse is its fault, not the
+// input's, and is worth retrying.
+func answer(data string, v interface{}) error {
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		return fmt.Errorf("unreadable answer from node helper: %v", err)
+	}
+	return nil
+}
+
+// returns the diff undoing commit, given the JSON-ified text it was made
+// against
+func invert(text string, commit Commit) git.Diff {
+	return git.Invert(unquote(text), commit.Diff)
+}
+
+func marshal(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
 }
@@ -0,0 +1,154 @@
+package pad
+
+// defines Commit, the unit of change clients send and receive. on the wire a
+// commit is the JSON object the javascript client builds, e.g.
+//
+//   {"clientID":1,"parent":4,"diff":[{"type":"Insert","index":0,"val":"a"}],"id":7}
+//
+// commits are validated when they reach the server, before they are proposed,
+// so every commit in the paxos log can be rebased and applied.
+//
+// a diff's indexes and sizes count UTF-16 code units, as javascript does,
+// unless the commit's unit says otherwise. the server converts commits to
+// UTF-16 when they arrive and stores nothing else, and converts them back to
+// any unit a client asks for with the "index-unit" header.
+//
+// the server records when each commit was proposed, as "proposed". peers
+// decide on a commit at different times, so that is the only time they agree
+// on.
+
+import (
+	"../git"
+	"encoding/json"
+	"fmt"
+)
+
+type Commit struct {
+	ClientID  int        `json:"clientID"`
+	Parent    int        `json:"parent"`
+	Head      int        `json:"head,omitempty"` // last commit squashed into this one, if any
+	Diff      git.Diff   `json:"diff"`
+	ID        int64      `json:"id"`
+	Conflicts []Conflict `json:"conflicts,omitempty"`
+	Unit      string     `json:"unit,omitempty"`     // git.UTF16, git.Runes or git.Bytes; "" is UTF16
+	Proposed  int64      `json:"proposed,omitempty"` // when it was proposed in Unix nanoseconds, set by the server
+}
+
+// part of a commit which was dropped or trimmed while rebasing it over commits
+// From through To. stored in the rebased commit, so every client sees it.
+type Conflict struct {
+	git.Conflict
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// so the field methods below do not call themselves
+type commitFields Commit
+
+// javascript clients iterate over diff without checking it exists, so an empty
+// diff is written as [] rather than null.
+func (c Commit) MarshalJSON() ([]byte, error) {
+	if c.Diff == nil {
+		c.Diff = git.Diff{}
+	}
+	return json.Marshal(commitFields(c))
+}
+
+// also accepts the JSON-ified string commits were stored as before they had a
+// type of their own, so older doc files still load. "" is the empty commit.
+func (c *Commit) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		s := ""
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if s == "" {
+			*c = Commit{}
+			return nil
+		}
+		data = []byte(s)
+	}
+	return json.Unmarshal(data, (*commitFields)(c))
+}
+
+func (c Commit) String() string {
+	return marshal(c)
+}
+
+// returned for commits, and requests for commits, older than a doc's base.
+// those commits were compacted, so the client must re-init to catch up.
+type GoneError struct {
+	Base int
+}
+
+func (e *GoneError) Error() string {
+	return fmt.Sprintf("commits up to %v were compacted, re-init", e.Base)
+}
+
+// returned for a doc which was deleted, and cannot be used again
+type DeletedError struct {
+	Name string
+}
+
+func (e *DeletedError) Error() string {
+	return fmt.Sprintf("doc %q was deleted", e.Name)
+}
+
+// returns an error if commit cannot be put onto a doc whose commits run from
+// base to head: a GoneError if its parent was compacted, otherwise a
+// MalformedError unless its parent exists and its diff is valid.
+func (c Commit) validate(base, head int) error {
+	if !git.KnownUnit(c.Unit) {
+		return &MalformedError{fmt.Sprintf("unknown index unit %q", c.Unit)}
+	}
+	if c.Parent >= 0 && c.Parent < base {
+		return &GoneError{base}
+	}
+	if c.Parent < 0 || c.Parent > head {
+		return &MalformedError{fmt.Sprintf("parent %v is not between 0 and head %v", c.Parent, head)}
+	}
+	if err := c.Diff.Validate(); err != nil {
+		return &MalformedError{err.Error()}
+	}
+	return nil
+}
+
+// returns a MalformedError unless every op of c's diff falls within text, the
+// JSON-ified text as of its parent. c must count UTF-16 code units.
+func (c Commit) checkBounds(text string) error {
+	if err := c.Diff.CheckBounds(git.Len(unquote(text))); err != nil {
+		return &MalformedError{err.Error()}
+	}
+	return nil
+}
+
+// returns commit with its diff counted in unit instead, given the JSON-ified
+// text it applies to. conflicts are left in UTF-16.
+func ConvertCommit(text string, commit Commit, unit string) (Commit, error) {
+	diff, err := git.ConvertDiff(unquote(text), commit.Diff, commit.Unit, unit)
+	if err != nil {
+		return Commit{}, &MalformedError{err.Error()}
+	}
+	commit.Diff = diff
+	commit.Unit = unit
+	if git.SameUnit(unit, git.UTF16) {
+		commit.Unit = ""
+	}
+	return commit, nil
+}
+
+// returns a MalformedError unless every commit counts UTF-16 code units, the
+// only unit diffs can be rebased and composed in
+func requireUTF16(commits ...Commit) error {
+	for _, c := range commits {
+		if !git.SameUnit(c.Unit, git.UTF16) {
+			return &MalformedError{fmt.Sprintf("%v indexes must be converted to %v first", c.Unit, git.UTF16)}
+		}
+	}
+	return nil
+}
+
+// assembles a commit the same way the javascript client does
+func MakeCommit(clientID int, parent int, diff git.Diff, id int64) Commit {
+	return Commit{ClientID: clientID, Parent: parent, Diff: diff, ID: id}
+}
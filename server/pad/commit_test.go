@@ -0,0 +1,58 @@
+package pad
+
+import (
+	"../git"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// commits reaching past the end of the text as of their parent are rejected
+// before they are proposed, and dropped if one is in the log anyway, since
+// rebasing a stale one over a squash would fail on every replica
+func TestPutOutOfRange(t *testing.T) {
+	ps := testServer(t)
+	edit(t, ps, "doc", "ab")
+	edit(t, ps, "doc", "abc")
+	edit(t, ps, "doc", "abcd")
+
+	for _, body := range []string{
+		`{"clientID":1,"parent":1,"diff":[{"type":"Insert","index":3000000000,"val":"x"}],"id":7}`,
+		`{"clientID":1,"parent":1,"diff":[{"type":"Delete","index":1,"size":2}],"id":7}`,
+		`{"clientID":1,"parent":3,"diff":[{"type":"Insert","index":5,"val":"x"}],"id":7}`,
+	} {
+		r := httptest.NewRequest("POST", "/commits/put", strings.NewReader(body))
+		r.Header.Set("doc-id", "doc")
+		w := httptest.NewRecorder()
+		ps.commitPutter(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("putting %s replied %v, not %v", body, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	stale := MakeCommit(1, 1, git.Diff{{Type: git.Insert, Index: 3000000000, Val: "x"}}, nrand())
+	if err := ps.getDoc("doc").putCommit(stale, ps); err == nil {
+		t.Fatalf("putting %v succeeded", stale)
+	} else if _, ok := err.(*MalformedError); !ok {
+		t.Fatalf("putting %v failed with %v, not a MalformedError", stale, err)
+	}
+	if _, err := run(ps, makeOp(PUT, PutArgs{stale, "doc", ""})); err != nil {
+		t.Fatalf("putting %v was not dropped: %v", stale, err)
+	}
+	expectText(t, ps, "doc", 3, "abcd")
+}
+
+// a stale commit is rebased over each commit since its parent in turn, which
+// rebasing over a squash of them does not always match
+func TestPutStale(t *testing.T) {
+	ps := testServer(t)
+	edit(t, ps, "doc", "b")
+	edit(t, ps, "doc", "ab")
+	edit(t, ps, "doc", "")
+	editAt(t, ps, "doc", 1, "b", "ab")
+
+	// the insert lands between "a" and "b", which the second commit deletes.
+	// rebased over a squash, which only deletes "b", it would be kept.
+	expectText(t, ps, "doc", 4, "")
+}
@@ -0,0 +1,95 @@
+package pad
+
+import (
+	"../git"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	ps := testServer(t)
+	ps.retention = 3
+	ps.snapshotInterval = 2
+	ref := testPeer(t, "8081")
+	ref.retention = 0
+	ref.snapshotInterval = 0
+	texts := []string{"a", "ab", "xab", "xaby", "xy", "xyz", "wxyz", "wz", "wzz", "w z z"}
+	for _, text := range texts {
+		edit(t, ps, "doc", text)
+		edit(t, ref, "doc", text)
+	}
+
+	// commits before the last few are folded into the base, once there are
+	// twice as many as are kept
+	doc := ps.getDoc("doc")
+	if base, head := doc.getBounds(); base != 6 || head != 10 {
+		t.Fatalf("doc has commits %v to %v, not 6 to 10", base, head)
+	}
+	if want := `"xyz"`; doc.baseText != want {
+		t.Fatalf("doc's base text is %v, not %v", doc.baseText, want)
+	}
+	for i := 7; i <= 10; i++ {
+		if !reflect.DeepEqual(doc.commit(i).Diff, ref.getDoc("doc").commit(i).Diff) {
+			t.Fatalf("commit %v is %v, not %v", i, doc.commit(i), ref.getDoc("doc").commit(i))
+		}
+	}
+
+	// blame rebuilt from the base is the same as if nothing was compacted
+	doc.mu.Lock()
+	doc.blame, doc.blamed = nil, 0
+	doc.mu.Unlock()
+	if blame, want := doc.getBlame(), ref.getDoc("doc").getBlame(); !reflect.DeepEqual(blame, want) {
+		t.Fatalf("blame rebuilt from the base is %v, not %v", blame, want)
+	}
+
+	// snapshots after the base are kept, and still give the text as of them
+	indexes := []int{}
+	for _, s := range doc.snapshots {
+		indexes = append(indexes, s.index)
+	}
+	if !reflect.DeepEqual(indexes, []int{8, 10}) {
+		t.Fatalf("snapshots at %v are kept, not at 8 and 10", indexes)
+	}
+	doc.Id = 1
+	ps.ppd.syncDoc("doc", doc)
+	if kept := ps.ppd.loadSnapshots(doc); !reflect.DeepEqual(kept, doc.snapshots) {
+		t.Fatalf("snapshots %v are written as %v", doc.snapshots, kept)
+	}
+	for i := 6; i <= 10; i++ {
+		if text, _ := doc.getTextAt(i, ps.merger); text != git.Quote(texts[i-1]) {
+			t.Fatalf("text as of %v is %v, not %q", i, text, texts[i-1])
+		}
+	}
+
+	// commits whose parent was compacted cannot be rebased, and commits at
+	// or before the base cannot be got, so clients must re-init
+	stale := MakeCommit(1, 5, git.GetDiff("xy", "xy!"), nrand())
+	if err := doc.putCommit(stale, ps); err == nil {
+		t.Fatalf("putting %v succeeded", stale)
+	} else if _, ok := err.(*GoneError); !ok {
+		t.Fatalf("putting %v failed with %v, not a GoneError", stale, err)
+	}
+	r := httptest.NewRequest("POST", "/commits/put", strings.NewReader(stale.String()))
+	r.Header.Set("doc-id", "doc")
+	w := httptest.NewRecorder()
+	ps.commitPutter(w, r)
+	if w.Code != http.StatusGone {
+		t.Fatalf("putting %v replied %v, not %v", stale, w.Code, http.StatusGone)
+	}
+	for next, code := range map[int]int{6: http.StatusGone, 7: http.StatusOK} {
+		r := httptest.NewRequest("POST", "/commits/get", nil)
+		r.Header.Set("doc-id", "doc")
+		r.Header.Set("next-commit", strconv.Itoa(next))
+		w := httptest.NewRecorder()
+		ps.commitGetter(w, r)
+		if w.Code != code {
+			t.Fatalf("getting commit %v replied %v, not %v", next, w.Code, code)
+		}
+	}
+	editAt(t, ps, "doc", 6, "xyz", "xyz!")
+	expectText(t, ps, "doc", 11, "w z z!")
+}
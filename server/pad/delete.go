@@ -0,0 +1,95 @@
+package pad
+
+// deletion of docs. deleting a doc leaves a tombstone in its place on every
+// peer, so it is never created again by someone looking at it: requests about
+// it are answered with 410 Gone, as are clients waiting for its next commit.
+// its files are removed, and the metadata file is rewritten with a line for
+// each tombstone, such as
+//
+//   {"Id":0,"Name":"old-notes","Deleted":true}
+//
+// /delete deletes the doc given by the "doc-id" header once every peer has.
+
+import (
+	"net/http"
+	"time"
+)
+
+// deletes the doc with the given name. fails with a DeletedError if it was
+// already deleted.
+func (ps *PadServer) deleteDoc(docID string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.tombstones[docID] {
+		return &DeletedError{docID}
+	}
+	ps.tombstones[docID] = true
+	if doc, ok := ps.docs[docID]; ok {
+		delete(ps.docs, docID)
+		doc.mu.Lock()
+		doc.Deleted = true
+		for _, c := range doc.listeners {
+			close(c)
+		}
+		doc.listeners = nil
+		doc.mu.Unlock()
+		ps.ppd.removeDoc(doc)
+	}
+	ps.ppd.writeMetadata()
+	return nil
+}
+
+// returns an empty doc marked deleted, which is not one of the server's docs
+func deletedDoc(docID string) *Doc {
+	doc := &Doc{}
+	doc.commits = make([]Commit, 1)
+	doc.Name = docID
+	doc.text = "\"\""
+	doc.baseText = doc.text
+	doc.Deleted = true
+	return doc
+}
+
+// returns the names of every deleted doc
+func (ps *PadServer) deletedDocs() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	names := make([]string, 0, len(ps.tombstones))
+	for name := range ps.tombstones {
+		names = append(names, name)
+	}
+	return names
+}
+
+// wraps a handler of requests about the doc given by the "doc-id" header so
+// requests about a deleted doc are answered with 410 Gone instead. requests
+// about an alias are handled as if about the doc it refers to, see rename.go.
+func (ps *PadServer) live(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		docID := r.Header.Get("doc-id")
+		ps.mu.Lock()
+		if target, ok := ps.target(docID, time.Now().UnixNano()); ok {
+			docID = target
+			r.Header.Set("doc-id", docID)
+			w.Header().Set("renamed-to", docID)
+		}
+		deleted := ps.tombstones[docID]
+		ps.mu.Unlock()
+		if deleted {
+			mergerError(w, &DeletedError{docID})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (ps *PadServer) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	docID := r.Header.Get("doc-id")
+	if docID == "" {
+		http.Error(w, "doc-id is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := ps.proposeAndWait(makeOp(DELETE, DeleteArgs{docID})); err != nil {
+		mergerError(w, err)
+	}
+}
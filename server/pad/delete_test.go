@@ -0,0 +1,54 @@
+package pad
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeleteReleasesListeners(t *testing.T) {
+	ps := testServer(t)
+	edit(t, ps, "draft", "one")
+
+	// a client waiting for the next commit is told the doc was deleted
+	released := make(chan error, 1)
+	go func() {
+		_, err := ps.get(2, "draft")
+		released <- err
+	}()
+	for {
+		doc := ps.getDoc("draft")
+		doc.mu.Lock()
+		waiting := len(doc.listeners)
+		doc.mu.Unlock()
+		if waiting > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := run(ps, makeOp(DELETE, DeleteArgs{"draft"})); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-released:
+		if _, ok := err.(*DeletedError); !ok {
+			t.Fatalf("waiting for the next commit of a deleted doc gave %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiting for the next commit of a deleted doc never returned")
+	}
+
+	// the doc is never created again, and is still deleted after restarting
+	if _, err := run(ps, makeOp(DELETE, DeleteArgs{"draft"})); err == nil {
+		t.Fatal("deleted a doc twice")
+	}
+	if _, err := run(ps, makeOp(CREATE, CreateArgs{"draft", nrand()})); err == nil {
+		t.Fatal("created a deleted doc")
+	}
+	if _, err := ps.get(1, "draft"); err == nil {
+		t.Fatal("got a commit of a deleted doc")
+	}
+	restarted := testPeer(t, ps.port)
+	if !restarted.tombstones["draft"] {
+		t.Fatal("forgot the doc was deleted after restarting")
+	}
+}
@@ -0,0 +1,403 @@
+package pad
+
+// defines a compact binary encoding for commits, used for commits sent through
+// paxos, the doc files written by the persistence worker and, when asked for,
+// commits sent to clients. JSON stays the format clients send commits in, and
+// doc files written as JSON are still read.
+//
+// an encoded commit is a version byte followed by varints and
+// length-prefixed strings:
+//
+//   version clientID parent head id #ops op... #conflicts conflict... unit time
+//   op:       kind index (size | len(val) val)
+//   conflict: kind op from to
+//
+// where each kind is a single byte. a page of history, for clients which
+// accept binary commits, is its entries followed by the cursor of the next
+// page, 0 after the last:
+//
+//   #entries (index len(commit) commit)... next
+//
+// a doc's snapshots are written to a file of their own next to its doc file:
+//
+//   magic version #snapshots (index len(text) text)...
+
+import (
+	"../git"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// version of the encoding written. version 2 added the unit, version 3
+	// the time and version 4 marked conflicts; decoding still accepts older
+	// versions.
+	COMMITENCODING = 4
+
+	// content type of binary commits in HTTP requests and replies
+	BINARYCOMMIT = "application/vnd.pad.commit"
+
+	// starts every binary doc file, followed by its version. version 2 added
+	// the doc's merge mode, version 3 its base, version 4 the doc it was
+	// forked from and version 5 its tags; older files are still read.
+	DOCFILEMAGIC   = "PADDOC"
+	DOCFILEVERSION = 5
+
+	// starts every snapshot file, followed by its version
+	SNAPSHOTMAGIC   = "PADSNAP"
+	SNAPSHOTVERSION = 1
+)
+
+const (
+	opInsert byte = iota
+	opDelete
+)
+
+const (
+	conflictDropped byte = iota
+	conflictTrimmed
+	conflictMarked
+)
+
+var errCorrupt = errors.New("corrupt or truncated encoding")
+
+// commits sent through paxos are encoded compactly rather than by reflection
+func (c Commit) GobEncode() ([]byte, error) {
+	return encodeCommit(c), nil
+}
+
+func (c *Commit) GobDecode(data []byte) error {
+	commit, err := decodeCommit(data)
+	*c = commit
+	return err
+}
+
+func encodeCommit(c Commit) []byte {
+	w := &encoder{}
+	w.buf.WriteByte(COMMITENCODING)
+	w.int(int64(c.ClientID))
+	w.int(int64(c.Parent))
+	w.int(int64(c.Head))
+	w.int(c.ID)
+	w.int(int64(len(c.Diff)))
+	for _, op := range c.Diff {
+		w.op(op)
+	}
+	w.int(int64(len(c.Conflicts)))
+	for _, conflict := range c.Conflicts {
+		switch conflict.Type {
+		case git.Trimmed:
+			w.buf.WriteByte(conflictTrimmed)
+		case git.Marked:
+			w.buf.WriteByte(conflictMarked)
+		default:
+			w.buf.WriteByte(conflictDropped)
+		}
+		w.op(conflict.Op)
+		w.int(int64(conflict.From))
+		w.int(int64(conflict.To))
+	}
+	w.string(c.Unit)
+	w.int(c.Proposed)
+	return w.buf.Bytes()
+}
+
+// returns the commit encoded in data, or an error if it is not one
+func decodeCommit(data []byte) (Commit, error) {
+	r := &decoder{bytes.NewReader(data)}
+	c := Commit{}
+	version, err := r.ReadByte()
+	if err != nil {
+		return c, errCorrupt
+	} else if version < 1 || version > COMMITENCODING {
+		return c, fmt.Errorf("unknown commit encoding version %v", version)
+	}
+	c.ClientID = int(r.int())
+	c.Parent = int(r.int())
+	c.Head = int(r.int())
+	c.ID = r.int()
+	c.Diff = make(git.Diff, r.count())
+	for i := range c.Diff {
+		c.Diff[i] = r.op()
+	}
+	if n := r.count(); n > 0 {
+		c.Conflicts = make([]Conflict, n)
+		for i := range c.Conflicts {
+			switch r.byte() {
+			case conflictDropped:
+				c.Conflicts[i].Type = git.Dropped
+			case conflictTrimmed:
+				c.Conflicts[i].Type = git.Trimmed
+			case conflictMarked:
+				c.Conflicts[i].Type = git.Marked
+			default:
+				r.fail()
+			}
+			c.Conflicts[i].Op = r.op()
+			c.Conflicts[i].From = int(r.int())
+			c.Conflicts[i].To = int(r.int())
+		}
+	}
+	if version >= 2 {
+		c.Unit = r.string()
+	}
+	if version >= 3 {
+		c.Proposed = r.int()
+	}
+	return c, r.err()
+}
+
+func encodeHistoryPage(page HistoryPage) []byte {
+	w := &encoder{}
+	w.int(int64(len(page.Entries)))
+	for _, entry := range page.Entries {
+		w.int(int64(entry.Index))
+		w.bytes(encodeCommit(entry.Commit))
+	}
+	w.int(int64(page.Next))
+	return w.buf.Bytes()
+}
+
+// returns the page of history encoded in data. the client ID and proposal time
+// of each entry are those of its commit.
+func decodeHistoryPage(data []byte) (HistoryPage, error) {
+	r := &decoder{bytes.NewReader(data)}
+	page := HistoryPage{Entries: make([]HistoryEntry, r.count())}
+	for i := range page.Entries {
+		page.Entries[i].Index = int(r.int())
+		commit, err := decodeCommit(r.bytes())
+		if err != nil {
+			return HistoryPage{}, err
+		}
+		page.Entries[i] = HistoryEntry{page.Entries[i].Index, commit.ClientID, commit.Proposed, commit}
+	}
+	page.Next = int(r.int())
+	return page, r.err()
+}
+
+// encodes a doc file: its merge mode, its JSON-ified text, when it was last
+// written, its commits, each length-prefixed, then its base, the text as of
+// the base and the blame spans as of the base, the doc it was forked from and
+// at which commit, and lastly its tags, each a name and a commit
+func encodeDocData(data *PersistentDocData) []byte {
+	w := &encoder{}
+	w.buf.WriteString(DOCFILEMAGIC)
+	w.buf.WriteByte(DOCFILEVERSION)
+	w.string(data.Mode)
+	w.string(data.Content)
+	w.int(data.Time)
+	w.int(int64(len(data.Commits)))
+	for _, commit := range data.Commits {
+		w.bytes(encodeCommit(commit))
+	}
+	w.int(int64(data.Base))
+	w.string(data.BaseText)
+	w.int(int64(len(data.BaseBlame)))
+	for _, s := range data.BaseBlame {
+		w.int(int64(s.Length))
+		w.int(int64(s.Commit))
+		w.int(int64(s.ClientID))
+	}
+	w.string(data.Origin)
+	w.int(int64(data.ForkPoint))
+	w.int(int64(len(data.Tags)))
+	for _, tag := range sortedTags(data.Tags) {
+		w.string(tag.Name)
+		w.int(int64(tag.Commit))
+	}
+	return w.buf.Bytes()
+}
+
+// reports whether b was written by encodeDocData rather than as JSON
+func isBinaryDocData(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(DOCFILEMAGIC))
+}
+
+func decodeDocData(b []byte) (*PersistentDocData, error) {
+	r := &decoder{bytes.NewReader(b[len(DOCFILEMAGIC):])}
+	version := r.byte()
+	if version < 1 || version > DOCFILEVERSION {
+		return nil, fmt.Errorf("unknown doc file version %v", version)
+	}
+	data := &PersistentDocData{}
+	if version >= 2 {
+		data.Mode = r.string()
+	}
+	data.Content = r.string()
+	data.Time = r.int()
+	data.Commits = make([]Commit, r.count())
+	for i := range data.Commits {
+		commit, err := decodeCommit(r.bytes())
+		if err != nil {
+			return nil, err
+		}
+		data.Commits[i] = commit
+	}
+	if version >= 3 {
+		data.Base = int(r.int())
+		data.BaseText = r.string()
+		data.BaseBlame = make([]blameSpan, r.count())
+		for i := range data.BaseBlame {
+			data.BaseBlame[i] = blameSpan{int(r.int()), int(r.int()), int(r.int())}
+		}
+	}
+	if version >= 4 {
+		data.Origin = r.string()
+		data.ForkPoint = int(r.int())
+	}
+	if version >= 5 {
+		if n := r.count(); n > 0 {
+			data.Tags = make(map[string]int, n)
+			for i := 0; i < n; i++ {
+				name := r.string()
+				data.Tags[name] = int(r.int())
+			}
+		}
+	}
+	return data, r.err()
+}
+
+func encodeSnapshots(snapshots []snapshot) []byte {
+	w := &encoder{}
+	w.buf.WriteString(SNAPSHOTMAGIC)
+	w.buf.WriteByte(SNAPSHOTVERSION)
+	w.int(int64(len(snapshots)))
+	for _, s := range snapshots {
+		w.int(int64(s.index))
+		w.string(s.text)
+	}
+	return w.buf.Bytes()
+}
+
+func decodeSnapshots(b []byte) ([]snapshot, error) {
+	if !bytes.HasPrefix(b, []byte(SNAPSHOTMAGIC)) {
+		return nil, errCorrupt
+	}
+	r := &decoder{bytes.NewReader(b[len(SNAPSHOTMAGIC):])}
+	if version := r.byte(); version != SNAPSHOTVERSION {
+		return nil, fmt.Errorf("unknown snapshot file version %v", version)
+	}
+	snapshots := make([]snapshot, r.count())
+	for i := range snapshots {
+		snapshots[i].index = int(r.int())
+		snapshots[i].text = r.string()
+	}
+	return snapshots, r.err()
+}
+
+type encoder struct {
+	buf     bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (w *encoder) int(x int64) {
+	n := binary.PutVarint(w.scratch[:], x)
+	w.buf.Write(w.scratch[:n])
+}
+
+func (w *encoder) bytes(b []byte) {
+	w.int(int64(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *encoder) string(s string) {
+	w.int(int64(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *encoder) op(op git.Op) {
+	if op.Type == git.Delete {
+		w.buf.WriteByte(opDelete)
+		w.int(int64(op.Index))
+		w.int(int64(op.Size))
+	} else {
+		w.buf.WriteByte(opInsert)
+		w.int(int64(op.Index))
+		w.string(op.Val)
+	}
+}
+
+// reads what an encoder wrote. the first failure is remembered, after which
+// every read returns a zero value, so callers check err() once at the end.
+type decoder struct {
+	*bytes.Reader
+}
+
+func (r *decoder) err() error {
+	if r.Reader == nil {
+		return errCorrupt
+	}
+	return nil
+}
+
+func (r *decoder) fail() {
+	r.Reader = nil
+}
+
+func (r *decoder) byte() byte {
+	if r.Reader == nil {
+		return 0
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		r.fail()
+	}
+	return b
+}
+
+func (r *decoder) int() int64 {
+	if r.Reader == nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(r)
+	if err != nil {
+		r.fail()
+	}
+	return x
+}
+
+// reads a length or count, which can never be more than the bytes left
+func (r *decoder) count() int {
+	n := r.int()
+	if r.Reader == nil || n < 0 || n > int64(r.Len()) {
+		r.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (r *decoder) bytes() []byte {
+	n := r.count()
+	if r.Reader == nil {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		r.fail()
+	}
+	return b
+}
+
+func (r *decoder) string() string {
+	return string(r.bytes())
+}
+
+func (r *decoder) op() git.Op {
+	op := git.Op{}
+	switch r.byte() {
+	case opInsert:
+		op.Type = git.Insert
+		op.Index = int(r.int())
+		op.Val = r.string()
+	case opDelete:
+		op.Type = git.Delete
+		op.Index = int(r.int())
+		op.Size = int(r.int())
+	default:
+		r.fail()
+	}
+	return op
+}
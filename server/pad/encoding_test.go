@@ -0,0 +1,111 @@
+package pad
+
+import (
+	"../git"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// half of a surrogate pair, which inserts may carry
+var loneSurrogate = git.ApplyDiff("😀", git.Diff{{Type: git.Delete, Index: 1, Size: 1}})
+
+func TestCommitEncoding(t *testing.T) {
+	insert := git.Op{Type: git.Insert, Index: 2, Val: "x" + loneSurrogate}
+	remove := git.Op{Type: git.Delete, Index: 4, Size: 3}
+	commits := []Commit{
+		{Diff: git.Diff{}},
+		{ClientID: 1, Parent: 4, Diff: git.Diff{insert, remove}, ID: -7},
+		{ClientID: 2, Parent: 9, Head: 12, Diff: git.Diff{remove}, ID: 1 << 40, Proposed: 1415000000000000000},
+		{ClientID: 3, Parent: 1, Diff: git.Diff{insert}, ID: 8, Conflicts: []Conflict{
+			{git.Conflict{Type: git.Dropped, Op: insert}, 2, 2},
+			{git.Conflict{Type: git.Trimmed, Op: remove}, 2, 5},
+			{git.Conflict{Type: git.Marked, Op: git.Op{Type: git.Insert, Index: 0, Val: "<<<<<<<\n"}}, 3, 3},
+		}},
+		{Parent: 1, Diff: git.Diff{insert}, Unit: git.UTF16},
+		{Parent: 1, Diff: git.Diff{insert}, Unit: git.Runes},
+		{Parent: 1, Diff: git.Diff{remove}, Unit: git.Bytes},
+	}
+	for _, c := range commits {
+		decoded, err := decodeCommit(encodeCommit(c))
+		if err != nil {
+			t.Fatalf("decoding %v: %v", c, err)
+		}
+		if !reflect.DeepEqual(decoded, c) {
+			t.Errorf("%v decodes as %v", c, decoded)
+		}
+	}
+
+	// unknown versions and conflict kinds are errors rather than guesses
+	b := encodeCommit(commits[3])
+	b[0] = COMMITENCODING + 1
+	if _, err := decodeCommit(b); err == nil {
+		t.Error("decoded a commit of an unknown version")
+	}
+	b = encodeCommit(Commit{Diff: git.Diff{}, Conflicts: []Conflict{{git.Conflict{Op: insert}, 1, 1}}})
+	b[7] = 9 // after the version, five fields and the count of conflicts
+	if c, err := decodeCommit(b); err == nil {
+		t.Errorf("decoded a conflict of an unknown kind as %v", c)
+	}
+}
+
+func TestDocDataEncoding(t *testing.T) {
+	commits := []Commit{{Diff: git.Diff{}}, {ClientID: 1, Diff: git.Diff{{Type: git.Insert, Index: 0, Val: "ab"}}, ID: 3}}
+	docs := []*PersistentDocData{
+		{Content: `"ab"`, Commits: commits, Time: 5, BaseText: `""`, BaseBlame: []blameSpan{}},
+		{Content: `"ab"`, Commits: commits, Time: 5, Mode: CHARMODE, BaseText: `""`, BaseBlame: []blameSpan{}},
+		{Content: `"a\nb\n"`, Commits: commits[1:], Time: 6, Mode: LINEMODE, Base: 4,
+			BaseText: `"a\n"`, BaseBlame: []blameSpan{{2, 4, 1}}},
+		{Content: `"ab"`, Commits: commits, Mode: CHARMODE, BaseText: `""`, BaseBlame: []blameSpan{},
+			Origin: "/docs/draft", ForkPoint: 1, Tags: map[string]int{"v1": 1, "empty": 0}},
+	}
+	for _, data := range docs {
+		b := encodeDocData(data)
+		if !isBinaryDocData(b) {
+			t.Fatalf("%v is not written as a binary doc file", marshal(data))
+		}
+		decoded, err := decodeDocData(b)
+		if err != nil {
+			t.Fatalf("decoding %v: %v", marshal(data), err)
+		}
+		if !reflect.DeepEqual(decoded, data) {
+			t.Errorf("%v decodes as %v", marshal(data), marshal(decoded))
+		}
+	}
+}
+
+// doc files written as JSON, with commits as JSON-ified strings or objects,
+// are still read, and replaced by binary ones once synced
+func TestJSONDocFile(t *testing.T) {
+	ps := testServer(t)
+	doc := ps.NewDoc("/docs/old")
+	doc.Id = 12
+	legacy := `{"Content":"\"ab\"","Time":5,"Commits":["",` +
+		`"{\"clientID\":1,\"parent\":0,\"diff\":[{\"type\":\"Insert\",\"index\":0,\"val\":\"a\"}],\"id\":3}",` +
+		`{"clientID":1,"parent":1,"diff":[{"type":"Insert","index":1,"val":"b"}],"id":4}]}`
+	if err := ioutil.WriteFile(ps.ppd.jsonPathForDoc(doc), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := &PersistentDocData{Content: `"ab"`, Time: 5, Commits: []Commit{
+		{},
+		{ClientID: 1, Diff: git.Diff{{Type: git.Insert, Index: 0, Val: "a"}}, ID: 3},
+		{ClientID: 1, Parent: 1, Diff: git.Diff{{Type: git.Insert, Index: 1, Val: "b"}}, ID: 4},
+	}}
+	data := ps.ppd.loadDoc(doc)
+	if !reflect.DeepEqual(data, want) {
+		t.Fatalf("the JSON doc file loads as %v, not %v", marshal(data), marshal(want))
+	}
+
+	doc.text, doc.commits, doc.lastWritten = data.Content, data.Commits, data.Time
+	if err := ps.ppd.syncDoc(doc.Name, doc); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := exists(ps.ppd.jsonPathForDoc(doc)); ok {
+		t.Fatal("the JSON doc file was kept once synced")
+	}
+	data = ps.ppd.loadDoc(doc)
+	if data.Content != want.Content || marshal(data.Commits) != marshal(want.Commits) {
+		t.Fatalf("the synced doc file loads as %v, not %v", marshal(data), marshal(want))
+	}
+}
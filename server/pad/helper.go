@@ -0,0 +1,186 @@
+package pad
+
+// defines a NodeHelper, a Merger which launches its own node server as a child
+// process and supervises it, so each replica is a single process to operate.
+// the helper listens on a port picked when it is launched, is health checked
+// every HEALTHINTERVAL, and is relaunched whenever it exits or stops answering.
+
+import (
+	"../git"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	HEALTHINTERVAL = 500 * time.Millisecond // between health checks
+	HEALTHFAILURES = 3                      // failed checks before a relaunch
+	RELAUNCHDELAY  = 1 * time.Second        // wait before relaunching
+)
+
+// Supervisor is implemented by Mergers which depend on a helper process. the
+// PadServer starts it, kills it with itself, and only applies commits while it
+// is healthy.
+type Supervisor interface {
+	Start() error
+	Healthy() bool
+	Kill()
+}
+
+type NodeHelper struct {
+	mu      sync.Mutex
+	script  string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser // held open for as long as the node server should run
+	nm      *NodeMerger    // talks to the currently running node server
+	exited  chan bool      // closed when the current node server exits
+	healthy bool
+	dead    bool
+}
+
+// script is the path to git-server.js.
+func MakeNodeHelper(script string) *NodeHelper {
+	nh := &NodeHelper{}
+	nh.script = script
+	return nh
+}
+
+func (nh *NodeHelper) GetDiff(a, b string) (git.Diff, error) {
+	return nh.merger().GetDiff(a, b)
+}
+
+func (nh *NodeHelper) Rebase(c1, c2 Commit) (Commit, error) {
+	return nh.merger().Rebase(c1, c2)
+}
+
+func (nh *NodeHelper) ApplyDiff(text string, commit Commit) (string, error) {
+	return nh.merger().ApplyDiff(text, commit)
+}
+
+func (nh *NodeHelper) merger() *NodeMerger {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	return nh.nm
+}
+
+// launches the node server and starts supervising it in the background
+func (nh *NodeHelper) Start() error {
+	if err := nh.launch(); err != nil {
+		return err
+	}
+	go nh.supervise()
+	return nil
+}
+
+func (nh *NodeHelper) Healthy() bool {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	return nh.healthy
+}
+
+// stops supervising and kills the node server
+func (nh *NodeHelper) Kill() {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	nh.dead = true
+	nh.healthy = false
+	if nh.cmd != nil {
+		nh.cmd.Process.Kill()
+	}
+}
+
+// starts a node server on a free port. it is not healthy until it first
+// answers a health check.
+func (nh *NodeHelper) launch() error {
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("node", nh.script, port, "supervised")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// never written to; it closes when this process exits, and the node
+	// server exits with it
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan bool)
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	nh.cmd = cmd
+	nh.stdin = stdin
+	nh.nm = MakeNodeMerger(port)
+	nh.exited = exited
+	nh.healthy = false
+	return nil
+}
+
+// health checks the node server until it is killed, relaunching it whenever
+// it exits or fails too many checks in a row.
+func (nh *NodeHelper) supervise() {
+	failures := 0
+	for {
+		nh.mu.Lock()
+		dead := nh.dead
+		exited := nh.exited
+		cmd := nh.cmd
+		nh.mu.Unlock()
+		if dead {
+			return
+		}
+
+		select {
+		case <-exited:
+			nh.mu.Lock()
+			nh.healthy = false
+			dead = nh.dead
+			nh.mu.Unlock()
+			if dead {
+				return
+			}
+			fmt.Println("node helper exited, relaunching:", cmd.ProcessState)
+			time.Sleep(RELAUNCHDELAY)
+			if err := nh.launch(); err != nil {
+				fmt.Println("node helper could not be launched:", err)
+			}
+			failures = 0
+		case <-time.After(HEALTHINTERVAL):
+			err := nh.merger().ping()
+			nh.mu.Lock()
+			nh.healthy = err == nil
+			nh.mu.Unlock()
+			if err == nil {
+				failures = 0
+			} else if failures += 1; failures >= HEALTHFAILURES {
+				// killing it makes it exit, which relaunches it
+				fmt.Println("node helper is unresponsive, killing it:", err)
+				cmd.Process.Kill()
+				failures = 0
+			}
+		}
+	}
+}
+
+// returns a port nothing is listening on right now
+func freePort() (string, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port), nil
+}
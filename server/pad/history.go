@@ -0,0 +1,136 @@
+package pad
+
+// serves a doc's history a page at a time, for review tooling and activity
+// views. a page is requested with headers like every other endpoint:
+//
+//   doc-id            the doc
+//   cursor            index of the first commit to consider, the first one
+//                     kept if absent
+//   to                index of the last commit to consider, head if absent
+//   limit             most commits in the page, HISTORYPAGE if absent
+//   filter-client-id  only include commits made by this client
+//   index-unit        unit the diffs count, as for any other commit
+//
+// and the reply is JSON such as
+//
+//   {"entries":[{"index":1,"clientID":3,"proposed":1414800000000000000,"commit":{...}}],"next":2}
+//
+// where next is the cursor of the following page, absent after the last one.
+// requests which accept BINARYCOMMIT are replied to with the page binary
+// encoded instead, see encodeHistoryPage. asking for commits which were
+// compacted is answered with 410 Gone.
+
+import (
+	"../git"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// commits in a page of history, unless the request asks for fewer
+	HISTORYPAGE    = 100
+	MAXHISTORYPAGE = 1000
+)
+
+// one commit in a doc's history. proposed is when it was proposed, which is
+// the only time every peer agrees on, and is absent for commits made before
+// the server recorded it.
+type HistoryEntry struct {
+	Index    int    `json:"index"`
+	ClientID int    `json:"clientID"`
+	Proposed int64  `json:"proposed,omitempty"`
+	Commit   Commit `json:"commit"`
+}
+
+type HistoryPage struct {
+	Entries []HistoryEntry `json:"entries"`
+	Next    int            `json:"next,omitempty"`
+}
+
+// returns up to limit of the commits from index from through to, only those
+// made by clientID if filter is set, and the index to continue from, or 0 if
+// there are no more. from must be after base and to at most head.
+func (doc *Doc) history(from, to, limit int, filter bool, clientID int) ([]HistoryEntry, int, error) {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if from <= doc.base {
+		return nil, 0, &GoneError{doc.base}
+	}
+	entries := []HistoryEntry{}
+	for i := from; i <= to; i++ {
+		if len(entries) == limit {
+			return entries, i, nil
+		}
+		c := doc.commit(i)
+		if !filter || c.ClientID == clientID {
+			entries = append(entries, HistoryEntry{i, c.ClientID, c.Proposed, c})
+		}
+	}
+	return entries, 0, nil
+}
+
+func (ps *PadServer) historyHandler(w http.ResponseWriter, r *http.Request) {
+	doc := ps.getDoc(r.Header.Get("doc-id"))
+	base, head := doc.getBounds()
+
+	from, to, limit := base+1, head, HISTORYPAGE
+	var err error
+	if h := r.Header.Get("cursor"); h != "" {
+		if from, err = strconv.Atoi(h); err != nil || from < 1 {
+			http.Error(w, fmt.Sprintf("invalid cursor %q", h), http.StatusBadRequest)
+			return
+		}
+	}
+	if h := r.Header.Get("to"); h != "" {
+		if to, err = strconv.Atoi(h); err != nil || to < 0 {
+			http.Error(w, fmt.Sprintf("invalid commit %q", h), http.StatusBadRequest)
+			return
+		} else if to > head {
+			to = head
+		}
+	}
+	if h := r.Header.Get("limit"); h != "" {
+		if limit, err = strconv.Atoi(h); err != nil || limit < 1 || limit > MAXHISTORYPAGE {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %v", MAXHISTORYPAGE), http.StatusBadRequest)
+			return
+		}
+	}
+	unit := r.Header.Get("index-unit")
+	if !git.KnownUnit(unit) {
+		http.Error(w, fmt.Sprintf("unknown index unit %q", unit), http.StatusBadRequest)
+		return
+	}
+	clientID := 0
+	filter := r.Header.Get("filter-client-id") != ""
+	if filter {
+		if clientID, err = strconv.Atoi(r.Header.Get("filter-client-id")); err != nil {
+			http.Error(w, "invalid client ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page := HistoryPage{}
+	if page.Entries, page.Next, err = doc.history(from, to, limit, filter, clientID); err != nil {
+		mergerError(w, err)
+		return
+	}
+
+	for i := range page.Entries {
+		if page.Entries[i].Commit, err = doc.convert(page.Entries[i].Commit, unit, ps.merger); err != nil {
+			mergerError(w, err)
+			return
+		}
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), BINARYCOMMIT) {
+		w.Header().Add("Content-Type", BINARYCOMMIT)
+		w.Write(encodeHistoryPage(page))
+	} else {
+		b, _ := json.Marshal(page)
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
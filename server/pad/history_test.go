@@ -0,0 +1,44 @@
+package pad
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// a page of history is the same whether it is replied to as JSON or, for
+// clients which accept binary commits, binary encoded
+func TestHistoryBinary(t *testing.T) {
+	ps := testServer(t)
+	for _, text := range []string{"a", "ab", "abc"} {
+		edit(t, ps, "doc", text)
+	}
+	pages := [2]HistoryPage{}
+	for i, accept := range []string{"application/json", BINARYCOMMIT} {
+		r := httptest.NewRequest("GET", "/commits/history", nil)
+		r.Header.Set("doc-id", "doc")
+		r.Header.Set("limit", "2")
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		ps.historyHandler(w, r)
+		var err error
+		if accept != BINARYCOMMIT {
+			err = json.Unmarshal(w.Body.Bytes(), &pages[i])
+		} else {
+			pages[i], err = decodeHistoryPage(w.Body.Bytes())
+		}
+		if err != nil {
+			t.Fatalf("reading the reply to Accept %q: %v", accept, err)
+		}
+		if w.Header().Get("Content-Type") != accept {
+			t.Fatalf("the reply to Accept %q is %v", accept, w.Header().Get("Content-Type"))
+		}
+	}
+	if len(pages[0].Entries) != 2 || pages[0].Next != 3 {
+		t.Fatalf("the first page is %v", marshal(pages[0]))
+	}
+	if !reflect.DeepEqual(pages[0], pages[1]) {
+		t.Fatalf("the binary page is %v, not %v", marshal(pages[1]), marshal(pages[0]))
+	}
+}
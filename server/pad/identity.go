@@ -0,0 +1,83 @@
+package pad
+
+// identity of docs. a doc's ID names its files on disk, so every peer must
+// give a doc the same one for their files to be interchangeable. docs looked
+// at before anyone committed to them are only placeholders, with ID 0, which
+// are never written to disk. a doc is created, and given its ID, by a CREATE
+// op, which every handler that can make a doc's first commit proposes first
+// if this server does not know of the doc yet. if peers propose to create the
+// same doc at once, the first CREATE decided wins and the others do nothing.
+//
+// docs created before CREATE was introduced were given a random ID by each
+// peer. the SYNC op each peer proposes on starting carries its docs' IDs, and
+// every peer renames a doc, and its files, to the smallest ID any peer has
+// for it, so they agree once every peer has synced.
+
+import (
+	"fmt"
+	"os"
+)
+
+// gives the doc with the given name the given ID, unless it already has one.
+// fails with a DeletedError if it was deleted.
+func (ps *PadServer) createDoc(docID string, id int64) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.tombstones[docID] {
+		return &DeletedError{docID}
+	}
+	doc, ok := ps.docs[docID]
+	if !ok {
+		doc = ps.NewDoc(docID)
+		ps.docs[docID] = doc
+	}
+	doc.mu.Lock()
+	created := doc.Id != 0
+	if !created {
+		doc.Id = id
+	}
+	doc.mu.Unlock()
+	if created {
+		return nil
+	}
+	ps.ppd.writeMetadata()
+	// create doc file on disk
+	os.Create(ps.ppd.pathForDoc(doc))
+	return nil
+}
+
+// returns the ID of the doc, 0 if it was not created yet
+func (doc *Doc) getId() int64 {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	return doc.Id
+}
+
+// makes sure the doc with the given name was created before anything is
+// committed to it, proposing to create it if this server does not know of it
+func (ps *PadServer) create(docID string) error {
+	if ps.getDoc(docID).getId() != 0 {
+		return nil
+	}
+	_, err := ps.proposeAndWait(makeOp(CREATE, CreateArgs{docID, nrand()}))
+	return err
+}
+
+// fails with a MalformedError if the doc was not created. the caller must
+// hold doc.mu.
+func (doc *Doc) created() error {
+	if doc.Id == 0 {
+		return &MalformedError{fmt.Sprintf("%q was never created", doc.Name)}
+	}
+	return nil
+}
+
+// gives the doc id, another peer's ID for it, if it is smaller than its own
+func (ps *PadServer) reconcile(doc *Doc, id int64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if mine := doc.getId(); id == 0 || (mine != 0 && mine <= id) {
+		return
+	}
+	ps.ppd.moveDoc(doc, id)
+}
@@ -0,0 +1,75 @@
+package pad
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCreateFirstWins(t *testing.T) {
+	ps := testServer(t)
+
+	// peers which propose to create a doc at once each propose their own ID,
+	// and every peer keeps the one decided first
+	for _, id := range []int64{7, 3} {
+		if _, err := run(ps, makeOp(CREATE, CreateArgs{"draft", id})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if id := ps.getDoc("draft").getId(); id != 7 {
+		t.Fatalf("draft was given ID %v, not 7", id)
+	}
+
+	// nothing can be committed to a doc which was never created
+	commit := MakeCommit(1, 0, nil, nrand())
+	ps.exec(makeOp(PUT, PutArgs{commit, "never", ""}))
+	if h, _ := ps.getDoc("never").getState(); h != 0 {
+		t.Fatalf("committed to a doc which was never created")
+	}
+}
+
+func TestReconcileIds(t *testing.T) {
+	a := testServer(t)
+	b := testPeer(t, "8081")
+
+	// before docs were created through paxos, each peer gave a doc an ID of
+	// its own
+	run(a, makeOp(CREATE, CreateArgs{"draft", 5}))
+	run(b, makeOp(CREATE, CreateArgs{"draft", 3}))
+	for _, ps := range []*PadServer{a, b} {
+		edit(t, ps, "draft", "one")
+		if err := ps.ppd.syncDoc("draft", ps.getDoc("draft")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every peer interprets every peer's sync, in the same order, and ends up
+	// with the smallest ID and files named after it
+	syncs := []Op{
+		makeOp(SYNC, SyncArgs{a.createDocData(), a.deletedDocs(), a.allAliases()}),
+		makeOp(SYNC, SyncArgs{b.createDocData(), b.deletedDocs(), b.allAliases()}),
+	}
+	for _, ps := range []*PadServer{a, b} {
+		for _, op := range syncs {
+			if _, err := run(ps, op); err != nil {
+				t.Fatal(err)
+			}
+		}
+		doc := ps.getDoc("draft")
+		if id := doc.getId(); id != 3 {
+			t.Fatalf("peer %v gave draft ID %v, not 3", ps.port, id)
+		}
+		if ok, _ := exists(ps.ppd.pathForDoc(doc)); !ok {
+			t.Fatalf("peer %v has no file for draft under its new ID", ps.port)
+		}
+		expectText(t, ps, "draft", 1, "one")
+	}
+	if _, err := os.Stat("./docs" + a.port + "/5" + DOCFILE); err == nil {
+		t.Fatal("the file for the old ID was left behind")
+	}
+
+	// and still has it after restarting
+	restarted := testPeer(t, a.port)
+	if id := restarted.getDoc("draft").getId(); id != 3 {
+		t.Fatalf("after restarting, draft has ID %v, not 3", id)
+	}
+}
@@ -1,9 +1,9 @@
 package pad
 
 import (
+	"../git"
 	"crypto/rand"
 	"encoding/gob"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -11,7 +11,6 @@ import (
 	"net"
 	"net/http"
 	"net/rpc"
-	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,9 +24,10 @@ import (
 // PadServers. Each PadServer communicates with each other via a paxos log to
 // apply updates to documents. Each PadServer also serves the actual frontend's
 // webpage. Go to /docs/DocID for any DocID for a document. Each pad server
-// rebases each incoming update by essentially making an RPC call to a locally
-// running node server. This is done because the client and server use the same
-// code and the client can only run javascript. Additionally, each PadServer
+// rebases each incoming update using its Merger, either the git package, a Go
+// port of the javascript the clients use, or a locally running node server
+// running that javascript itself. Either way both sides merge identically.
+// Additionally, each PadServer
 // maintains a current state of the document so that new clients do not have to
 // replay the entire history of the document to become current.
 //
@@ -45,38 +45,86 @@ type PadServer struct {
 	dead       bool // for testing
 	unreliable bool // for testing
 	px         *Paxos
+	merger     Merger
 
 	docs         map[string]*Doc
+	tombstones   map[string]bool  // names of deleted docs, see delete.go
+	aliases      map[string]Alias // names of renamed docs, see rename.go
 	ppd          *PadPersistenceWorker
 	peers        []string
 	port         string
 	lastExecuted int
-	dups         map[Commit]bool
+	dups         map[commitKey]bool // commits already put
 	syncCount    int
+
+	snapshotInterval int           // commits between snapshots of each doc's text
+	retention        int           // commits each doc keeps before compacting, see compact
+	aliasPeriod      time.Duration // how long renamed docs' old names last
+
+	waiting map[int64]chan result // by op ID, handlers waiting for their op
+}
+
+// identifies a commit put onto a doc. clients pick commit IDs themselves, the
+// browser from the time in milliseconds, so IDs alone are not unique.
+type commitKey struct {
+	DocId    string
+	ClientID int
+	ID       int64
 }
 
 type Doc struct {
-	commits     []Commit
+	commits     []Commit // from base through head
 	mu          sync.Mutex
 	timeLock    sync.Mutex
 	listeners   []chan Commit
 	Id          int64
 	Name        string //TODO: Make a Doc metadata structure to store doc identification
+	Deleted     bool   `json:",omitempty"` // the doc was deleted and must not be used
+	AliasOf     string `json:",omitempty"` // only set in the metadata lines of aliases
+	Expires     int64  `json:",omitempty"` // when the alias expires, in Unix nanoseconds
 	text        string
 	lastWritten int64
+	squashes    map[int]*squash
+	mode        string // CHARMODE or LINEMODE; "" until the first commit
+	snapshots   []snapshot
+	blame       []blameSpan    // who wrote each part of text, see blame.go
+	blamed      int            // last commit blame is up to date with
+	base        int            // index of commits[0]; older commits were compacted
+	baseText    string         // JSON-ified text as of base
+	baseBlame   []blameSpan    // blame as of base
+	origin      string         // doc this one was forked from, if any
+	forkPoint   int            // commit of origin it was forked at
+	tags        map[string]int // commit each tag names, see tags.go
+}
+
+// the JSON-ified text of a doc as of one of its commits, so older versions of
+// the doc can be rebuilt without replaying its whole history. a doc's
+// snapshots are in order of index.
+type snapshot struct {
+	index int
+	text  string
+}
+
+// a single commit with the effect of every commit after parent up to head,
+// where head is the index of the last commit squashed into it.
+type squash struct {
+	head   int
+	commit Commit
 }
 
 type DocData struct {
+	Id          int64 // 0 if the peer sending it does not know its ID
 	Name        string
 	Text        string
 	LastWritten int64
 	Commits     []Commit
-}
-
-type Commit string
-
-type PartialCommit struct {
-	Parent int
+	Mode        string
+	Base        int
+	BaseText    string
+	BaseBlame   []blameSpan
+	Origin      string
+	ForkPoint   int
+	Tags        map[string]int
 }
 
 type Err string
@@ -85,11 +133,13 @@ type Op struct {
 	Op   string      // Operation
 	Args interface{} // Operation arguments
 	Id   int64       // Operation ID
+	Time int64       // when the op was proposed, in Unix nanoseconds
 }
 
 type PutArgs struct {
 	Commit Commit
 	DocId  string
+	Mode   string // merge mode of the doc, if this is its first commit
 }
 
 type GetArgs struct {
@@ -98,15 +148,83 @@ type GetArgs struct {
 }
 
 type SyncArgs struct {
-	Docs map[string]*DocData
+	Docs    map[string]*DocData
+	Deleted []string         // names of deleted docs
+	Aliases map[string]Alias // aliases of renamed docs, by name
+}
+
+type ForkArgs struct {
+	DocId  string // the new doc
+	Source string // the doc it is a copy of
+	At     int    // commit of source it is a copy as of
+}
+
+type MergeArgs struct {
+	DocId    string // the fork to merge into the doc it was forked from
+	ClientID int    // client asking for the merge
+	ID       int64  // ID of the commit the merge makes
+}
+
+type DeleteArgs struct {
+	DocId string
+}
+
+type RenameArgs struct {
+	DocId   string
+	NewName string
+	Period  time.Duration // how long DocId stays an alias of NewName
+}
+
+type CreateArgs struct {
+	DocId string
+	Id    int64 // ID of the doc, unless it already has one
+}
+
+type TagArgs struct {
+	DocId  string
+	Name   string
+	Commit int
+}
+
+// the outcome of an op, for the handler which proposed it
+type result struct {
+	commit Commit
+	err    error
 }
 
 const (
 	Debug = 0
-	PUT   = "Put"
-	GET   = "Get"
-	NOOP  = "Noop"
-	SYNC  = "Sync"
+
+	// number of squashes of recent commits each Doc keeps around
+	MAXSQUASHES = 16
+
+	// wait before interpreting an operation which failed again
+	RETRYINTERVAL = 1 * time.Second
+
+	// commits between snapshots of a doc's text, unless MakePadServer is
+	// given another interval
+	SNAPSHOTINTERVAL = 100
+
+	// commits kept by each doc before older ones are compacted, unless
+	// MakePadServer is given another retention
+	RETENTION = 1000
+
+	// merge modes of a doc, chosen by its first commit. CHARMODE rebases
+	// character by character, LINEMODE merges whole lines and keeps conflicting
+	// lines between markers.
+	CHARMODE = "chars"
+	LINEMODE = "lines"
+
+	PUT    = "Put"
+	GET    = "Get"
+	NOOP   = "Noop"
+	SYNC   = "Sync"
+	FORK   = "Fork"
+	MERGE  = "Merge"
+	TAG    = "Tag"
+	DELETE = "Delete"
+	RENAME = "Rename"
+	CREATE = "Create"
 )
 
 func DPrintf(format string, a ...interface{}) (n int, err error) {
@@ -134,37 +252,148 @@ func (ps *PadServer) Propose(proposal Op) bool {
 	return true
 }
 
+// proposes op and waits until it has been executed, returning its outcome.
+// only ops whose handlers send a result can be waited for.
+func (ps *PadServer) proposeAndWait(op Op) (Commit, error) {
+	c := make(chan result, 1)
+	ps.mu.Lock()
+	ps.waiting[op.Id] = c
+	ps.mu.Unlock()
+	ps.Propose(op)
+	r := <-c
+	return r.commit, r.err
+}
+
+// sends the outcome of op id to the handler waiting for it, if this server
+// proposed it
+func (ps *PadServer) reply(id int64, commit Commit, err error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if c, ok := ps.waiting[id]; ok {
+		c <- result{commit, err}
+		delete(ps.waiting, id)
+	}
+}
+
+// reports whether err means an op can never succeed, rather than that it
+// should be tried again. every peer fails such ops the same way, so they are
+// skipped.
+func dropped(err error) bool {
+	switch err.(type) {
+	case *MalformedError, *GoneError, *DeletedError:
+		return true
+	}
+	return false
+}
+
 // Given my current configuration state, should I propose?
 func (ps *PadServer) shouldPropose(op string, args interface{}) bool {
 	return true
 }
 
-// Interpret an operation from my paxos log and clear memory from it
+// Interpret an operation from my paxos log and clear memory from it. if the
+// operation could not be executed right now, e.g. because the merger is
+// unavailable, it is left in the log to be interpreted again later.
 func (ps *PadServer) Interpret(op Op) (Commit, Err) {
 	val, err := ps.exec(op)
+	if err != "" {
+		return val, err
+	}
 	ps.lastExecuted++
 	ps.px.Done(ps.lastExecuted)
 
 	return val, err
 }
 
+// Interpret an operation, pausing before it is retried if it failed. nothing
+// is interpreted while a supervised merger's helper is unhealthy.
+func (ps *PadServer) interpretOrWait(op Op) {
+	if s, ok := ps.merger.(Supervisor); ok && !s.Healthy() {
+		time.Sleep(HEALTHINTERVAL)
+		return
+	}
+	if _, err := ps.Interpret(op); err != "" {
+		fmt.Println("could not interpret", op.Op, "- retrying:", err)
+		time.Sleep(RETRYINTERVAL)
+	}
+}
+
 // Op handler and executer
 func (ps *PadServer) exec(op Op) (val Commit, err Err) {
 
 	// TODO: Duplicate detection
 
+	// ops made before ops had times leave aliases as they are
+	if op.Time > 0 {
+		ps.expireAliases(op.Time)
+	}
+
 	switch op.Op {
 	case SYNC:
 		args := op.Args.(SyncArgs)
-		ps.syncDocs(args.Docs)
+		ps.syncDocs(args.Docs, args.Deleted)
+		ps.syncAliases(args.Aliases, op.Time)
 		break
 	case PUT:
 		args := op.Args.(PutArgs)
-		if _, ok := ps.dups[args.Commit]; !ok {
-			ps.dups[args.Commit] = true
-			ps.put(args.Commit, args.DocId)
+		args.DocId = ps.resolve(args.DocId, op.Time)
+		key := commitKey{args.DocId, args.Commit.ClientID, args.Commit.ID}
+		if _, ok := ps.dups[key]; !ok {
+			args.Commit.Proposed = op.Time
+			if e := ps.put(args.Commit, args.DocId, args.Mode); e != nil {
+				if !dropped(e) {
+					return val, Err(e.Error())
+				}
+				fmt.Println("dropping commit", args.Commit, e)
+			}
+			ps.dups[key] = true
 		}
 
+		break
+	case FORK:
+		args := op.Args.(ForkArgs)
+		args.DocId = ps.resolve(args.DocId, op.Time)
+		args.Source = ps.resolve(args.Source, op.Time)
+		e := ps.fork(args.DocId, args.Source, args.At)
+		if e != nil && !dropped(e) {
+			return val, Err(e.Error())
+		}
+		ps.reply(op.Id, val, e)
+		break
+	case MERGE:
+		args := op.Args.(MergeArgs)
+		args.DocId = ps.resolve(args.DocId, op.Time)
+		val, e := ps.merge(args, op.Time)
+		if e != nil && !dropped(e) {
+			return val, Err(e.Error())
+		}
+		ps.reply(op.Id, val, e)
+		break
+	case TAG:
+		args := op.Args.(TagArgs)
+		args.DocId = ps.resolve(args.DocId, op.Time)
+		doc, e := ps.lookup(args.DocId)
+		if e == nil {
+			e = doc.tag(args.Name, args.Commit)
+		}
+		ps.reply(op.Id, val, e)
+		break
+	case DELETE:
+		args := op.Args.(DeleteArgs)
+		ps.reply(op.Id, val, ps.deleteDoc(ps.resolve(args.DocId, op.Time)))
+		break
+	case CREATE:
+		args := op.Args.(CreateArgs)
+		ps.reply(op.Id, val, ps.createDoc(ps.resolve(args.DocId, op.Time), args.Id))
+		break
+	case RENAME:
+		args := op.Args.(RenameArgs)
+		expires := int64(0)
+		if args.Period > 0 {
+			expires = op.Time + int64(args.Period)
+		}
+		e := ps.rename(ps.resolve(args.DocId, op.Time), args.NewName, expires)
+		ps.reply(op.Id, val, e)
 		break
 	}
 
@@ -198,150 +427,742 @@ func (ps *PadServer) WaitTillDecided(seq int) interface{} {
 }
 
 // DOC
+
+// returns a placeholder for the doc with the given name, which has no ID and
+// is not written to disk until it is created, see identity.go
 func (ps *PadServer) NewDoc(docID string) *Doc {
 	doc := &Doc{}
 	doc.commits = make([]Commit, 1)
 	doc.listeners = make([]chan Commit, 0)
-	doc.Id = nrand()
 	doc.Name = docID
 	doc.text = "\"\""
-
-	// append document identification data to metadata
-	fd, _ := os.OpenFile(METADATA+ps.port+JSON, os.O_RDWR|os.O_APPEND, 0644)
-	defer fd.Close()
-	b, _ := json.Marshal(doc)
-	fd.Write(b)
-	fd.Write([]byte("\n"))
-
-	// create doc file on disk
-	os.Create("./docs" + ps.port + "/" + strconv.FormatInt(doc.Id, 10) + JSON)
-
+	doc.baseText = doc.text
 	return doc
 }
 
-func (doc *Doc) getCommit(id int) Commit {
+// returns commit id, waiting for it to be put if need be. fails with a
+// GoneError if it was compacted.
+func (doc *Doc) getCommit(id int) (Commit, error) {
 	doc.mu.Lock()
+	if doc.Deleted {
+		doc.mu.Unlock()
+		return Commit{}, &DeletedError{doc.Name}
+	} else if doc.base > 0 && id <= doc.base {
+		doc.mu.Unlock()
+		return Commit{}, &GoneError{doc.base}
+	}
 	c := make(chan Commit, 1)
-	if id < len(doc.commits) {
-		c <- doc.commits[id]
+	if id <= doc.head() {
+		c <- doc.commit(id)
 	} else {
 		doc.listeners = append(doc.listeners, c)
 	}
 	doc.mu.Unlock()
-	return <-c
+	// the channel is closed if the doc is deleted meanwhile
+	commit, ok := <-c
+	if !ok {
+		return Commit{}, &DeletedError{doc.Name}
+	}
+	return commit, nil
+}
+
+// returns the index of the doc's last commit. the caller must hold doc.mu.
+func (doc *Doc) head() int {
+	return doc.base + len(doc.commits) - 1
+}
+
+// returns commit id, which must be between base and head. the caller must
+// hold doc.mu.
+func (doc *Doc) commit(id int) Commit {
+	return doc.commits[id-doc.base]
 }
 
-func (doc *Doc) putCommit(commit Commit, ps *PadServer) {
+// rebases commit to head and applies it. if the merger fails, the doc is left
+// untouched so the commit can be put again later.
+func (doc *Doc) putCommit(commit Commit, ps *PadServer) error {
 	doc.mu.Lock()
 	defer doc.mu.Unlock()
 
-	// TODO: REBASE COMMIT HERE
-	partialCommit := &PartialCommit{}
-	json.Unmarshal([]byte(commit), partialCommit)
-	rebaseCommit := commit
-	if partialCommit.Parent >= len(doc.commits) {
-		fmt.Println("parent", partialCommit.Parent, "head", len(doc.commits))
-		fmt.Println("commit", commit)
-		panic("given an invalid parent pointer by client")
+	// commits are validated before they are proposed, but check again in case
+	// an older replica proposed this one
+	if err := commit.validate(doc.base, doc.head()); err != nil {
+		return err
 	}
-	for i := partialCommit.Parent + 1; i < len(doc.commits); i++ {
-		rebaseCommit = ps.rebase(doc.commits[i], rebaseCommit)
+	if err := doc.compact(commit.Parent, ps); err != nil {
+		return err
+	}
+	if parentText, err := doc.textAt(commit.Parent, ps.merger); err != nil {
+		return err
+	} else if err := commit.checkBounds(parentText); err != nil {
+		return err
+	}
+	var rebaseCommit Commit
+	var err error
+	if doc.mode == LINEMODE {
+		rebaseCommit, err = doc.mergeLines(commit, ps.merger)
+	} else {
+		rebaseCommit, err = RebaseOver(ps.merger, doc.commits[commit.Parent+1-doc.base:], commit)
+	}
+	if err != nil {
+		return err
 	}
 
-	json.Unmarshal([]byte(rebaseCommit), partialCommit)
-	if partialCommit.Parent != len(doc.commits)-1 {
-		fmt.Println(rebaseCommit, len(doc.commits)-1)
+	// mergers need not keep fields they do not use
+	rebaseCommit.Proposed = commit.Proposed
+
+	if rebaseCommit.Parent != doc.head() {
+		fmt.Println(rebaseCommit, doc.head())
 		fmt.Println("commit", commit)
 		panic("a rebased commit was not rebased all the way to head")
 	}
 
-	doc.text = ps.applyDiff(doc.text, rebaseCommit)
+	text, err := ps.merger.ApplyDiff(doc.text, rebaseCommit)
+	if err != nil {
+		return err
+	}
+	doc.text = text
 
 	doc.commits = append(doc.commits, rebaseCommit)
+	doc.updateBlame()
+	if head := doc.head(); ps.snapshotInterval > 0 && head%ps.snapshotInterval == 0 {
+		doc.snapshots = append(doc.snapshots, snapshot{head, text})
+	}
 	for _, c := range doc.listeners {
 		c <- rebaseCommit
 	}
 	doc.listeners = make([]chan Commit, 0)
 
+	return nil
+}
+
+// rebases commit over each of history in turn, the commits after its parent in
+// order, as putCommit does. rebasing over a squash of them instead may resolve
+// overlapping edits differently.
+func RebaseOver(merger Merger, history []Commit, commit Commit) (Commit, error) {
+	var err error
+	for _, c := range history {
+		if commit, err = merger.Rebase(c, commit); err != nil {
+			return Commit{}, err
+		}
+	}
+	return commit, nil
+}
+
+// rebases commit to head by merging it line by line with everything committed
+// since its parent, rather than rebasing it over each of those commits. both
+// sides of conflicting lines are kept between markers and reported in the
+// commit's conflicts. the caller must hold doc.mu.
+func (doc *Doc) mergeLines(commit Commit, merger Merger) (Commit, error) {
+	head := doc.head()
+	merged := commit
+	merged.Parent = head
+	if commit.Parent == head {
+		return merged, nil
+	}
+	base, err := doc.textAt(commit.Parent, merger)
+	if err != nil {
+		return Commit{}, err
+	}
+	incoming, err := merger.ApplyDiff(base, commit)
+	if err != nil {
+		return Commit{}, err
+	}
+	text, conflicts := git.MergeLines(unquote(base), unquote(doc.text), unquote(incoming))
+	merged.Diff = git.LineDiff(unquote(doc.text), text)
+	if len(conflicts) > 0 {
+		merged.Conflicts = append([]Conflict{}, commit.Conflicts...)
+		for _, c := range conflicts {
+			merged.Conflicts = append(merged.Conflicts, Conflict{c, commit.Parent + 1, head})
+		}
+	}
+	return merged, nil
+}
+
+// folds the commits before the retention window into the doc's base, so
+// neither memory nor its doc file grows forever. to do so less often, it waits
+// until the doc has twice as many commits as it keeps. it never folds past
+// parent, the parent of the commit about to be put, so that commit can still
+// be rebased. every peer puts the same commits in the same order, so every
+// peer compacts to the same base. the caller must hold doc.mu.
+func (doc *Doc) compact(parent int, ps *PadServer) error {
+	head := doc.head()
+	if ps.retention <= 0 || head-doc.base < 2*ps.retention {
+		return nil
+	}
+	base := head - ps.retention
+	if parent < base {
+		base = parent
+	}
+	if base <= doc.base {
+		return nil
+	}
+	text, err := doc.textAt(base, ps.merger)
+	if err != nil {
+		return err
+	}
+
+	for i := doc.base + 1; i <= base; i++ {
+		c := doc.commit(i)
+		doc.baseBlame = applyBlame(doc.baseBlame, c.Diff, i, c.ClientID)
+	}
+	doc.commits = append([]Commit{}, doc.commits[base-doc.base:]...)
+	doc.base = base
+	doc.baseText = text
+	for len(doc.snapshots) > 0 && doc.snapshots[0].index <= base {
+		doc.snapshots = doc.snapshots[1:]
+	}
+	for p := range doc.squashes {
+		if p < base {
+			delete(doc.squashes, p)
+		}
+	}
+	return nil
+}
+
+// returns a single commit with the effect of every commit after parent, made
+// by extending a cached squash of them if there is one. the caller must hold
+// doc.mu.
+func (doc *Doc) squash(parent int, composer Composer) (Commit, error) {
+	if doc.squashes == nil {
+		doc.squashes = make(map[int]*squash)
+	}
+	s, ok := doc.squashes[parent]
+	if !ok {
+		// make room by forgetting the squash for the oldest parent
+		if len(doc.squashes) >= MAXSQUASHES {
+			oldest := -1
+			for p := range doc.squashes {
+				if oldest < 0 || p < oldest {
+					oldest = p
+				}
+			}
+			delete(doc.squashes, oldest)
+		}
+		s = &squash{parent + 1, doc.commit(parent + 1)}
+		doc.squashes[parent] = s
+	}
+	for s.head < doc.head() {
+		commit, err := composer.Compose(s.commit, doc.commit(s.head+1))
+		if err != nil {
+			return Commit{}, err
+		}
+		s.commit = commit
+		s.head += 1
+	}
+	return s.commit, nil
+}
+
+// returns a single commit, with from as its parent, which has the effect of
+// every commit after from up to and including to. the caller must make sure
+// 0 <= from < to <= head. fails with a GoneError if from was compacted.
+func (doc *Doc) getSquash(from, to int, composer Composer) (Commit, error) {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if from < doc.base {
+		return Commit{}, &GoneError{doc.base}
+	}
+	if to == doc.head() {
+		return doc.squash(from, composer)
+	}
+	var err error
+	commit := doc.commit(from + 1)
+	for i := from + 2; i <= to && err == nil; i++ {
+		commit, err = composer.Compose(commit, doc.commit(i))
+	}
+	return commit, err
+}
+
+// returns the doc's merge mode. docs without commits yet, and docs from before
+// there were modes, merge characters.
+func (doc *Doc) getMode() string {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if doc.mode == "" {
+		return CHARMODE
+	}
+	return doc.mode
+}
+
+// returns commit with its diff counted in unit, rebuilding the text as of its
+// parent to convert it if need be. takes doc.mu itself.
+func (doc *Doc) convert(commit Commit, unit string, merger Merger) (Commit, error) {
+	if git.SameUnit(commit.Unit, unit) {
+		return commit, nil
+	}
+	text, err := doc.getTextAt(commit.Parent, merger)
+	if err != nil {
+		return Commit{}, err
+	}
+	return ConvertCommit(text, commit, unit)
+}
+
+// returns commit with any ops which split a surrogate pair widened to whole
+// characters, see git.Realign, so no stored diff splits one. commits
+// validate would reject anyway are returned as they are.
+func (doc *Doc) realign(commit Commit, merger Merger) (Commit, error) {
+	base, head := doc.getBounds()
+	if !git.SameUnit(commit.Unit, git.UTF16) || commit.Parent < base || commit.Parent > head {
+		return commit, nil
+	}
+	text, err := doc.getTextAt(commit.Parent, merger)
+	if err != nil {
+		return Commit{}, err
+	}
+	diff, err := git.Realign(unquote(text), commit.Diff)
+	if err != nil {
+		return Commit{}, &MalformedError{err.Error()}
+	}
+	commit.Diff = diff
+	return commit, nil
+}
+
+// returns a MalformedError unless every op of commit falls within the doc's
+// text as of its parent, which must not have been compacted
+func (doc *Doc) checkBounds(commit Commit, merger Merger) error {
+	text, err := doc.getTextAt(commit.Parent, merger)
+	if err != nil {
+		return err
+	}
+	return commit.checkBounds(text)
+}
+
+// returns the doc's base and head, the first and last commits it has
+func (doc *Doc) getBounds() (base, head int) {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	return doc.base, doc.head()
 }
 
 func (doc *Doc) getState() (head int, text string) {
 	doc.mu.Lock()
 	defer doc.mu.Unlock()
-	head = len(doc.commits) - 1
+	head = doc.head()
 	text = doc.text
 	return
 }
 
+// returns the JSON-ified text of the document as of commit id, rebuilt by
+// replaying the commits after the nearest snapshot before it, or after the
+// base. fails with a GoneError if id was compacted. the caller must hold
+// doc.mu and make sure id <= head.
+func (doc *Doc) textAt(id int, merger Merger) (string, error) {
+	if id == doc.head() {
+		return doc.text, nil
+	} else if id < doc.base {
+		return "", &GoneError{doc.base}
+	}
+	var err error
+	from, text := doc.base, doc.baseText
+	for k := len(doc.snapshots) - 1; k >= 0; k-- {
+		if doc.snapshots[k].index <= id {
+			from, text = doc.snapshots[k].index, doc.snapshots[k].text
+			break
+		}
+	}
+	for i := from + 1; i <= id && err == nil; i++ {
+		text, err = merger.ApplyDiff(text, doc.commit(i))
+	}
+	return text, err
+}
+
+// same as textAt, but takes doc.mu itself.
+func (doc *Doc) getTextAt(id int, merger Merger) (string, error) {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	return doc.textAt(id, merger)
+}
+
 // HANDLERS
 
-func (ps *PadServer) syncDocs(otherDocs map[string]*DocData) {
+func (ps *PadServer) syncDocs(otherDocs map[string]*DocData, deleted []string) {
+	for _, name := range deleted {
+		if !ps.tombstones[name] {
+			ps.deleteDoc(name)
+		}
+	}
 	for otherDocName, otherDocData := range otherDocs {
-		if _, ok := ps.docs[otherDocName]; !ok {
+		if ps.tombstones[otherDocName] {
+			continue
+		} else if _, ok := ps.aliases[otherDocName]; ok {
+			continue
+		} else if _, ok := ps.docs[otherDocName]; !ok {
 			ps.docs[otherDocName] = ps.NewDoc(otherDocName)
 			ps.docs[otherDocName].text = otherDocData.Text
 			ps.docs[otherDocName].commits = otherDocData.Commits
 			ps.docs[otherDocName].lastWritten = otherDocData.LastWritten
+			ps.docs[otherDocName].mode = otherDocData.Mode
+			ps.docs[otherDocName].base = otherDocData.Base
+			ps.docs[otherDocName].baseText = otherDocData.BaseText
+			ps.docs[otherDocName].baseBlame = otherDocData.BaseBlame
+			ps.docs[otherDocName].origin = otherDocData.Origin
+			ps.docs[otherDocName].forkPoint = otherDocData.ForkPoint
+			ps.docs[otherDocName].tags = otherDocData.Tags
 		} else {
 			if ps.docs[otherDocName].lastWritten < otherDocData.LastWritten {
 				ps.docs[otherDocName].text = otherDocData.Text
 				ps.docs[otherDocName].commits = otherDocData.Commits
 				ps.docs[otherDocName].lastWritten = otherDocData.LastWritten
+				ps.docs[otherDocName].mode = otherDocData.Mode
+				ps.docs[otherDocName].base = otherDocData.Base
+				ps.docs[otherDocName].baseText = otherDocData.BaseText
+				ps.docs[otherDocName].baseBlame = otherDocData.BaseBlame
+				ps.docs[otherDocName].origin = otherDocData.Origin
+				ps.docs[otherDocName].forkPoint = otherDocData.ForkPoint
+				ps.docs[otherDocName].tags = otherDocData.Tags
+				ps.docs[otherDocName].squashes = nil
+				ps.docs[otherDocName].snapshots = nil
+				ps.docs[otherDocName].blame = nil
+				ps.docs[otherDocName].blamed = 0
 			}
 		}
+		ps.reconcile(ps.docs[otherDocName], otherDocData.Id)
 	}
 	ps.syncCount += 1
 }
 
-func (ps *PadServer) put(commit Commit, docID string) {
+// puts commit onto the doc. if it is the doc's first commit, it also decides
+// the doc's merge mode, CHARMODE unless mode says otherwise.
+func (ps *PadServer) put(commit Commit, docID string, mode string) error {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
+	if ps.tombstones[docID] {
+		return &DeletedError{docID}
+	}
 	doc, ok := ps.docs[docID]
 	if !ok {
-		ps.docs[docID] = ps.NewDoc(docID)
-		doc = ps.docs[docID]
+		return &MalformedError{fmt.Sprintf("%q was never created", docID)}
+	}
+	doc.mu.Lock()
+	if err := doc.created(); err != nil {
+		doc.mu.Unlock()
+		return err
 	}
-	doc.putCommit(Commit(commit), ps)
+	if doc.mode == "" && doc.head() == 0 {
+		doc.mode = CHARMODE
+		if mode != "" {
+			doc.mode = mode
+		}
+	}
+	doc.mu.Unlock()
+	return doc.putCommit(commit, ps)
+}
+
+func (ps *PadServer) get(nextCommit int, docID string) (Commit, error) {
+	return ps.getDoc(docID).getCommit(nextCommit)
 }
 
-func (ps *PadServer) get(nextCommit int, docID string) Commit {
+// returns the doc with the given ID, or the one it is an alias of, creating
+// it if it does not exist yet. a deleted doc is never created again; instead
+// an empty doc marked deleted, which belongs to no server, is returned.
+func (ps *PadServer) getDoc(docID string) *Doc {
 	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	docID, _ = ps.target(docID, time.Now().UnixNano())
+	if ps.tombstones[docID] {
+		return deletedDoc(docID)
+	}
 	doc, ok := ps.docs[docID]
 	if !ok {
 		ps.docs[docID] = ps.NewDoc(docID)
 		doc = ps.docs[docID]
 	}
-	ps.mu.Unlock()
-	return doc.getCommit(nextCommit)
+	return doc
 }
 
-func (ps *PadServer) initHandler(w http.ResponseWriter, r *http.Request) {
-	docID := r.Header.Get("doc-id")
+// returns the doc with the given name, which an op resolved as of when it was
+// proposed. fails with a MalformedError if there is no such doc and a
+// DeletedError if it was deleted. unlike getDoc, it neither follows aliases
+// as of now nor makes placeholders, which would differ between peers, so ops
+// use it.
+func (ps *PadServer) lookup(docID string) (*Doc, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.find(docID)
+}
+
+// same as lookup, but the caller must hold ps.mu.
+func (ps *PadServer) find(docID string) (*Doc, error) {
+	if ps.tombstones[docID] {
+		return nil, &DeletedError{docID}
+	}
 	doc, ok := ps.docs[docID]
 	if !ok {
-		ps.docs[docID] = ps.NewDoc(docID)
-		doc = ps.docs[docID]
+		return nil, &MalformedError{fmt.Sprintf("%q does not exist", docID)}
 	}
+	return doc, nil
+}
+
+// replies with the doc's current text and head, or with its text as of the
+// commit given by the "at-commit" header, or named by the "at-tag" header,
+// which then becomes the head.
+func (ps *PadServer) initHandler(w http.ResponseWriter, r *http.Request) {
+	doc := ps.getDoc(r.Header.Get("doc-id"))
 	head, text := doc.getState()
+	at := r.Header.Get("at-commit")
+	if tag := r.Header.Get("at-tag"); tag != "" {
+		commit, ok := doc.getTag(tag)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no tag %q", tag), http.StatusNotFound)
+			return
+		}
+		at = strconv.Itoa(commit)
+	}
+	if at != "" {
+		id, err := strconv.Atoi(at)
+		if err != nil || id < 0 || id > head {
+			http.Error(w, fmt.Sprintf("commit %q is not between 0 and head %v", at, head), http.StatusBadRequest)
+			return
+		}
+		if text, err = doc.getTextAt(id, ps.merger); err != nil {
+			mergerError(w, err)
+			return
+		}
+		head = id
+	}
 	w.Header().Add("Content-Type", "application/json")
 	w.Header().Add("head", strconv.Itoa(head))
+	w.Header().Add("merge-mode", doc.getMode())
 	w.Write([]byte(text))
 }
 
+// rejects commits which could not be rebased and applied with a 400, so they
+// never reach the paxos log
 func (ps *PadServer) commitPutter(w http.ResponseWriter, r *http.Request) {
 	docID := r.Header.Get("doc-id")
-	commit, _ := ioutil.ReadAll(r.Body)
+	body, _ := ioutil.ReadAll(r.Body)
+	commit := Commit{}
+	doc := ps.getDoc(docID)
+	mode, err := mergeMode(r)
+	if err == nil {
+		err = decode(string(body), &commit)
+	}
+	if err == nil {
+		// only the server reports conflicts and squashes, and records when
+		// commits were proposed
+		commit.Conflicts, commit.Head, commit.Proposed = nil, 0, 0
 
-	args := PutArgs{Commit(commit), docID}
-	proposal := Op{PUT, args, nrand()}
+		// javascript diffs may split surrogate pairs, which validate rejects
+		commit, err = doc.realign(commit, ps.merger)
+	}
+	if err == nil {
+		base, head := doc.getBounds()
+		err = commit.validate(base, head)
+	}
+	if err == nil {
+		// only UTF-16 commits are ever stored
+		commit, err = doc.convert(commit, git.UTF16, ps.merger)
+	}
+	if err == nil {
+		err = doc.checkBounds(commit, ps.merger)
+	}
+	if err != nil {
+		mergerError(w, err)
+		return
+	}
+
+	if err := ps.create(docID); err != nil {
+		mergerError(w, err)
+		return
+	}
+	args := PutArgs{commit, docID, mode}
+	proposal := makeOp(PUT, args)
+	ps.Propose(proposal)
+}
+
+// accepts the complete new text of a document as the body, for clients which
+// cannot compute diffs themselves. the diff is made against the text as of the
+// "parent" header, or head if it is absent, and proposed like any other commit.
+// replies with the commit it proposed.
+func (ps *PadServer) textReplacer(w http.ResponseWriter, r *http.Request) {
+	docID := r.Header.Get("doc-id")
+	newText, _ := ioutil.ReadAll(r.Body)
+	clientID, _ := strconv.Atoi(r.Header.Get("client-id"))
+	mode, err := mergeMode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	doc := ps.getDoc(docID)
+	head, _ := doc.getState()
+	parent := head
+	if r.Header.Get("parent") != "" {
+		if parent, err = strconv.Atoi(r.Header.Get("parent")); err != nil {
+			http.Error(w, "invalid parent", http.StatusBadRequest)
+			return
+		}
+	}
+	if parent < 0 || parent > head {
+		http.Error(w, "no such parent", http.StatusBadRequest)
+		return
+	}
+	oldText, err := doc.getTextAt(parent, ps.merger)
+	if err != nil {
+		mergerError(w, err)
+		return
+	}
+
+	var diff git.Diff
+	if doc.getMode() == LINEMODE {
+		diff = git.LineDiff(unquote(oldText), string(newText))
+	} else if diff, err = ps.merger.GetDiff(oldText, marshal(string(newText))); err == nil {
+		diff, err = git.Realign(unquote(oldText), diff)
+	}
+	if err != nil {
+		mergerError(w, err)
+		return
+	}
+	commit := MakeCommit(clientID, parent, diff, nrand())
+	if err := ps.create(docID); err != nil {
+		mergerError(w, err)
+		return
+	}
+	args := PutArgs{commit, docID, mode}
+	proposal := makeOp(PUT, args)
+	ps.Propose(proposal)
+	ps.writeCommit(w, r, doc, commit)
+}
+
+// undoes the commit given by the "commit" header by proposing its inverse with
+// that commit as the parent. like any other stale commit, putCommit then rebases
+// the inverse over everything committed since. replies with the commit it
+// proposed.
+func (ps *PadServer) commitUndoer(w http.ResponseWriter, r *http.Request) {
+	docID := r.Header.Get("doc-id")
+	doc := ps.getDoc(docID)
+	clientID, _ := strconv.Atoi(r.Header.Get("client-id"))
+	id, err := strconv.Atoi(r.Header.Get("commit"))
+	if err != nil || id < 1 {
+		http.Error(w, "invalid commit", http.StatusBadRequest)
+		return
+	}
+	mode, err := mergeMode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the text before the commit is needed to restore what it deleted
+	doc.mu.Lock()
+	if id > doc.head() {
+		doc.mu.Unlock()
+		http.Error(w, "no such commit", http.StatusBadRequest)
+		return
+	}
+	text, err := doc.textAt(id-1, ps.merger)
+	var diff git.Diff
+	if err == nil {
+		diff = invert(text, doc.commit(id))
+	}
+	doc.mu.Unlock()
+	if err != nil {
+		mergerError(w, err)
+		return
+	}
+
+	commit := MakeCommit(clientID, id, diff, nrand())
+	if err := ps.create(docID); err != nil {
+		mergerError(w, err)
+		return
+	}
+	args := PutArgs{commit, docID, mode}
+	proposal := makeOp(PUT, args)
 	ps.Propose(proposal)
+	ps.writeCommit(w, r, doc, commit)
+}
+
+// replies with a single commit which takes a client from the "from" commit to
+// the "to" commit, or head if it is absent, so catching up takes one request.
+// the commit's parent is from and the "head" header is set to to.
+func (ps *PadServer) commitComposer(w http.ResponseWriter, r *http.Request) {
+	composer, ok := ps.merger.(Composer)
+	if !ok {
+		http.Error(w, "merger cannot compose commits", http.StatusNotImplemented)
+		return
+	}
+	doc := ps.getDoc(r.Header.Get("doc-id"))
+	from, err := strconv.Atoi(r.Header.Get("from"))
+	if err != nil {
+		http.Error(w, "invalid from", http.StatusBadRequest)
+		return
+	}
+	head, _ := doc.getState()
+	to := head
+	if r.Header.Get("to") != "" {
+		if to, err = strconv.Atoi(r.Header.Get("to")); err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	if from < 0 || to <= from || to > head {
+		http.Error(w, "no such commits", http.StatusBadRequest)
+		return
+	}
+	commit, err := doc.getSquash(from, to, composer)
+	if err != nil {
+		mergerError(w, err)
+		return
+	}
+	w.Header().Add("head", strconv.Itoa(to))
+	ps.writeCommit(w, r, doc, commit)
 }
 
 func (ps *PadServer) commitGetter(w http.ResponseWriter, r *http.Request) {
 	docID := r.Header.Get("doc-id")
 	nextCommit, _ := strconv.Atoi(r.Header.Get("next-commit"))
-	commit := ps.get(nextCommit, docID)
-	w.Write([]byte(commit))
+	commit, err := ps.get(nextCommit, docID)
+	if err != nil {
+		mergerError(w, err)
+		return
+	}
+	ps.writeCommit(w, r, ps.getDoc(docID), commit)
+}
+
+// replies with commit, one of doc's, as JSON or binary encoded if the request
+// accepts it. its diff counts the unit given by the "index-unit" header, or
+// UTF-16 code units if there is none.
+func (ps *PadServer) writeCommit(w http.ResponseWriter, r *http.Request, doc *Doc, commit Commit) {
+	unit := r.Header.Get("index-unit")
+	if !git.KnownUnit(unit) {
+		http.Error(w, fmt.Sprintf("unknown index unit %q", unit), http.StatusBadRequest)
+		return
+	}
+	commit, err := doc.convert(commit, unit, ps.merger)
+	if err != nil {
+		mergerError(w, err)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), BINARYCOMMIT) {
+		w.Header().Add("Content-Type", BINARYCOMMIT)
+		w.Write(encodeCommit(commit))
+	} else {
+		w.Header().Add("Content-Type", "application/json")
+		w.Write([]byte(marshal(commit)))
+	}
+}
+
+// returns the merge mode the "merge-mode" header asks a new doc to use, if any.
+// it only takes effect if the request makes the doc's first commit.
+func mergeMode(r *http.Request) (string, error) {
+	mode := r.Header.Get("merge-mode")
+	if mode != "" && mode != CHARMODE && mode != LINEMODE {
+		return "", fmt.Errorf("unknown merge mode %q", mode)
+	}
+	return mode, nil
+}
+
+// reports an error from the merger to the client
+func mergerError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*MalformedError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if _, ok := err.(*GoneError); ok {
+		http.Error(w, err.Error(), http.StatusGone)
+	} else if _, ok := err.(*DeletedError); ok {
+		http.Error(w, err.Error(), http.StatusGone)
+	} else {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
 }
 
 func (ps *PadServer) docHandler(w http.ResponseWriter, r *http.Request) {
@@ -356,16 +1177,28 @@ func (ps *PadServer) docHandler(w http.ResponseWriter, r *http.Request) {
 func (ps *PadServer) createDocData() map[string]*DocData {
 	dataMap := make(map[string]*DocData)
 	for docName, doc := range ps.docs {
-		dataMap[docName] = &DocData{doc.Name, doc.text, doc.lastWritten, doc.commits}
+		if doc.Id == 0 {
+			continue
+		}
+		dataMap[docName] = &DocData{doc.Id, doc.Name, doc.text, doc.lastWritten, doc.commits, doc.mode,
+			doc.base, doc.baseText, doc.baseBlame, doc.origin, doc.forkPoint, doc.tags}
 	}
 	return dataMap
 }
 
+// returns an op with a new ID, proposed now
+func makeOp(op string, args interface{}) Op {
+	return Op{op, args, nrand(), time.Now().UnixNano()}
+}
+
 func (ps *PadServer) Kill() {
 	DPrintf("Kill(%d): die\n", ps.me)
 	ps.dead = true
 	ps.l.Close()
 	ps.px.Kill()
+	if s, ok := ps.merger.(Supervisor); ok {
+		s.Kill()
+	}
 }
 
 func nrand() int64 {
@@ -377,25 +1210,62 @@ func nrand() int64 {
 
 func (ps *PadServer) Start() {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/commits/put", ps.commitPutter)
-	mux.HandleFunc("/commits/get", ps.commitGetter)
-	mux.HandleFunc("/docs/", ps.docHandler)
-	mux.HandleFunc("/init", ps.initHandler)
+	mux.HandleFunc("/commits/put", ps.live(ps.commitPutter))
+	mux.HandleFunc("/commits/get", ps.live(ps.commitGetter))
+	mux.HandleFunc("/commits/replace", ps.live(ps.textReplacer))
+	mux.HandleFunc("/commits/compose", ps.live(ps.commitComposer))
+	mux.HandleFunc("/commits/undo", ps.live(ps.commitUndoer))
+	mux.HandleFunc("/commits/history", ps.live(ps.historyHandler))
+	mux.HandleFunc("/docs/", ps.redirect(ps.docHandler))
+	mux.HandleFunc("/init", ps.live(ps.initHandler))
+	mux.HandleFunc("/blame", ps.live(ps.blameHandler))
+	mux.HandleFunc("/fork", ps.live(ps.forkHandler))
+	mux.HandleFunc("/merge", ps.live(ps.mergeHandler))
+	mux.HandleFunc("/tags", ps.live(ps.tagsHandler))
+	mux.HandleFunc("/tags/put", ps.live(ps.tagPutter))
+	mux.HandleFunc("/delete", ps.live(ps.deleteHandler))
+	mux.HandleFunc("/rename", ps.live(ps.renameHandler))
 	mux.Handle("/js/", http.FileServer(http.Dir("./")))
 	log.Fatal(http.ListenAndServe(":"+ps.port, mux))
 }
 
 // PAD SERVER
 
-func MakePadServer(peers []string, me int) *PadServer {
+// merger performs all rebasing; every peer should be given the same kind. if
+// it is a Supervisor, its helper is started here and killed with the server.
+// snapshotInterval is how many commits apart each doc's snapshots are taken,
+// 0 for none, and retention how many commits each doc keeps before compacting
+// older ones, 0 to keep every commit. every peer must be given the same
+// retention. aliasPeriod is how long the old name of a renamed doc stays an
+// alias of the new one, 0 for no alias. all are given here, rather than set
+// later, since docs are loaded and synced with the other peers, and ops
+// served, before this returns.
+func MakePadServer(peers []string, me int, merger Merger, snapshotInterval, retention int, aliasPeriod time.Duration) *PadServer {
 	ps := &PadServer{}
+	ps.merger = merger
+	ps.snapshotInterval = snapshotInterval
+	ps.retention = retention
+	ps.aliasPeriod = aliasPeriod
+	if s, ok := merger.(Supervisor); ok {
+		if err := s.Start(); err != nil {
+			log.Fatal("merger helper error: ", err)
+		}
+	}
 	gob.Register(Op{})
 	gob.Register(Doc{})
 	gob.Register(DocData{})
 	gob.Register(PutArgs{})
 	gob.Register(GetArgs{})
 	gob.Register(SyncArgs{})
+	gob.Register(ForkArgs{})
+	gob.Register(MergeArgs{})
+	gob.Register(TagArgs{})
+	gob.Register(DeleteArgs{})
+	gob.Register(RenameArgs{})
+	gob.Register(CreateArgs{})
 	ps.docs = make(map[string]*Doc)
+	ps.tombstones = make(map[string]bool)
+	ps.aliases = make(map[string]Alias)
 	url := strings.Split(peers[me], ":")
 	ip := url[0]
 	rpcPortString := url[1]
@@ -417,7 +1287,8 @@ func MakePadServer(peers []string, me int) *PadServer {
 	}
 	ps.l = l
 
-	ps.dups = make(map[Commit]bool)
+	ps.dups = make(map[commitKey]bool)
+	ps.waiting = make(map[int64]chan result)
 
 	// for testing purposes
 	go func() {
@@ -450,14 +1321,14 @@ func MakePadServer(peers []string, me int) *PadServer {
 	}()
 
 	// Initiate sync phase to begin serving with the same universal state
-	proposal := Op{SYNC, SyncArgs{ps.createDocData()}, nrand()}
+	proposal := makeOp(SYNC, SyncArgs{ps.createDocData(), ps.deletedDocs(), ps.allAliases()})
 	ps.Propose(proposal)
 	done := make(chan bool, 1)
 	go func() {
 		for ps.syncCount < len(peers) {
 			seq := ps.lastExecuted + 1
 			if done, val := ps.px.Status(seq); done {
-				ps.Interpret(val.(Op))
+				ps.interpretOrWait(val.(Op))
 			} else {
 				time.Sleep(200 * time.Millisecond)
 			}
@@ -475,7 +1346,7 @@ func MakePadServer(peers []string, me int) *PadServer {
 		for {
 			seq := ps.lastExecuted + 1
 			if done, val := ps.px.Status(seq); done {
-				ps.Interpret(val.(Op))
+				ps.interpretOrWait(val.(Op))
 			} else {
 				time.Sleep(200 * time.Millisecond)
 			}
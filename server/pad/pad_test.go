@@ -0,0 +1,88 @@
+package pad
+
+import (
+	"../git"
+	"errors"
+	"os"
+	"testing"
+)
+
+// returns a server which is not connected to any peers and keeps its files in
+// a fresh directory. ops are executed by handing them to run, as if they had
+// just been decided.
+func testServer(t *testing.T) *PadServer {
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return testPeer(t, "8080")
+}
+
+// returns another such server, in the same directory, as a peer with the
+// given web port would be
+func testPeer(t *testing.T, port string) *PadServer {
+	ps := &PadServer{}
+	ps.merger = MakeNativeMerger()
+	ps.snapshotInterval = SNAPSHOTINTERVAL
+	ps.retention = RETENTION
+	ps.aliasPeriod = ALIASPERIOD
+	ps.port = port
+	ps.docs = make(map[string]*Doc)
+	ps.tombstones = make(map[string]bool)
+	ps.aliases = make(map[string]Alias)
+	ps.dups = make(map[commitKey]bool)
+	ps.waiting = make(map[int64]chan result)
+	ps.ppd = MakePersistenceWorker(ps)
+	return ps
+}
+
+// executes op and returns the commit and error it was replied to with, or
+// the error it failed with if it is to be tried again
+func run(ps *PadServer, op Op) (Commit, error) {
+	c := make(chan result, 1)
+	ps.mu.Lock()
+	ps.waiting[op.Id] = c
+	ps.mu.Unlock()
+	defer func() {
+		ps.mu.Lock()
+		delete(ps.waiting, op.Id)
+		ps.mu.Unlock()
+	}()
+	if _, err := ps.exec(op); err != "" {
+		return Commit{}, errors.New(string(err))
+	}
+	select {
+	case r := <-c:
+		return r.commit, r.err
+	default:
+		return Commit{}, nil
+	}
+}
+
+// creates docID if need be and commits the change from its current text to
+// text, as client 1
+func edit(t *testing.T, ps *PadServer, docID, text string) {
+	if _, err := run(ps, makeOp(CREATE, CreateArgs{docID, nrand()})); err != nil {
+		t.Fatal(err)
+	}
+	head, old := ps.getDoc(docID).getState()
+	editAt(t, ps, docID, head, unquote(old), text)
+}
+
+// commits the change from old, the text of docID as of parent, to text
+func editAt(t *testing.T, ps *PadServer, docID string, parent int, old, text string) {
+	commit := MakeCommit(1, parent, git.GetDiff(old, text), nrand())
+	if _, err := run(ps, makeOp(PUT, PutArgs{commit, docID, ""})); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fails unless docID's text is want and its head is head
+func expectText(t *testing.T, ps *PadServer, docID string, head int, want string) {
+	t.Helper()
+	h, text := ps.getDoc(docID).getState()
+	if unquote(text) != want || h != head {
+		t.Fatalf("%q is %q at %v, not %q at %v", docID, unquote(text), h, want, head)
+	}
+}
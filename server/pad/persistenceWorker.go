@@ -2,6 +2,7 @@ package pad
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,6 +14,8 @@ import (
 
 const (
 	JSON         = ".json"
+	DOCFILE      = ".pad"  // binary doc files, see encodeDocData
+	SNAPSHOTFILE = ".snap" // snapshots of a doc's text, see encodeSnapshots
 	METADATA     = "metadata"
 	WAITINTERVAL = 5 * time.Second
 )
@@ -27,12 +30,21 @@ type PadPersistenceWorker struct {
 
 /*
  * Representation of a Doc's data stored on disk. It includes the interpretted content
- * of all the commits encountered for the doc, and the commits themselves
+ * of all the commits encountered for the doc, and the commits themselves. Once a Doc
+ * has been compacted, the commits start from its base, whose content and blame are
+ * kept instead of the commits before it.
  */
 type PersistentDocData struct {
-	Content string
-	Commits []Commit
-	Time    int64
+	Content   string
+	Commits   []Commit
+	Time      int64
+	Mode      string
+	Base      int
+	BaseText  string
+	BaseBlame []blameSpan
+	Origin    string
+	ForkPoint int
+	Tags      map[string]int
 }
 
 /*
@@ -54,20 +66,49 @@ func MakePersistenceWorker(server *PadServer) *PadPersistenceWorker {
 }
 
 /*
- * Loads an individual Doc's PersistentDocData stored on disk
+ * Loads an individual Doc's PersistentDocData stored on disk. Docs which have not
+ * been synced since doc files became binary are read from their old JSON file.
  */
 func (ppd *PadPersistenceWorker) loadDoc(doc *Doc) *PersistentDocData {
 	path := ppd.pathForDoc(doc)
+	if ok, _ := exists(path); !ok {
+		path = ppd.jsonPathForDoc(doc)
+	}
 	// read whole the file
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		panic(err)
 	}
+	if isBinaryDocData(b) {
+		data, err := decodeDocData(b)
+		if err != nil {
+			panic(fmt.Sprintf("%v: %v", path, err))
+		}
+		return data
+	}
 	data := &PersistentDocData{}
 	json.Unmarshal(b, data)
 	return data
 }
 
+/*
+ * Loads the snapshots of a Doc stored next to its doc file, if there are any.
+ * Snapshots only save replaying commits, so a missing or unreadable file just
+ * means there are none.
+ */
+func (ppd *PadPersistenceWorker) loadSnapshots(doc *Doc) []snapshot {
+	b, err := ioutil.ReadFile(ppd.snapshotPathForDoc(doc))
+	if err != nil {
+		return nil
+	}
+	snapshots, err := decodeSnapshots(b)
+	if err != nil {
+		fmt.Printf("ignoring snapshots of %v: %v\n", doc.Name, err)
+		return nil
+	}
+	return snapshots
+}
+
 /*
  * For initialization of server from data on disk. Reads Doc identification data
  * stored as metadata and loads it into the server's state. If no metadata exists
@@ -81,11 +122,29 @@ func (ppd *PadPersistenceWorker) loadAllDocs() {
 		for line, _, err := r.ReadLine(); err != io.EOF; line, _, err = r.ReadLine() {
 			doc := &Doc{}
 			json.Unmarshal(line, doc)
+			if doc.Deleted {
+				ppd.ps.tombstones[doc.Name] = true
+				continue
+			} else if doc.AliasOf != "" {
+				ppd.ps.aliases[doc.Name] = Alias{doc.AliasOf, doc.Expires}
+				continue
+			}
 			ppd.ps.docs[doc.Name] = doc
 			docData := ppd.loadDoc(doc)
 			doc.commits = docData.Commits
 			doc.text = docData.Content
 			doc.lastWritten = docData.Time
+			doc.mode = docData.Mode
+			doc.base = docData.Base
+			doc.baseText = docData.BaseText
+			if doc.base == 0 {
+				doc.baseText = "\"\""
+			}
+			doc.baseBlame = docData.BaseBlame
+			doc.origin = docData.Origin
+			doc.forkPoint = docData.ForkPoint
+			doc.tags = docData.Tags
+			doc.snapshots = ppd.loadSnapshots(doc)
 		}
 		fmt.Println("Docs read from metaData: ", ppd.ps.docs)
 	} else {
@@ -101,18 +160,34 @@ func (ppd *PadPersistenceWorker) loadAllDocs() {
  */
 func (ppd *PadPersistenceWorker) syncDoc(docName string, doc *Doc) error {
 	doc.timeLock.Lock()
+	if doc.Deleted || doc.getId() == 0 {
+		// deleted docs are never written again, and placeholders never were
+		doc.timeLock.Unlock()
+		return nil
+	}
 	writeTime := time.Now().UnixNano()
 	if writeTime > doc.lastWritten {
 		doc.lastWritten = writeTime
 	}
-	newData := PersistentDocData{doc.text, doc.commits, doc.lastWritten}
-	b, _ := json.Marshal(newData)
+	newData := PersistentDocData{doc.text, doc.commits, doc.lastWritten, doc.mode,
+		doc.base, doc.baseText, doc.baseBlame, doc.origin, doc.forkPoint, doc.tags}
+	b := encodeDocData(&newData)
 	err := ioutil.WriteFile(ppd.pathForDoc(doc), b, 0644)
+	doc.mu.Lock()
+	snapshots := doc.snapshots
+	doc.mu.Unlock()
+	if err == nil && len(snapshots) > 0 {
+		err = ioutil.WriteFile(ppd.snapshotPathForDoc(doc), encodeSnapshots(snapshots), 0644)
+	} else if err == nil {
+		os.Remove(ppd.snapshotPathForDoc(doc))
+	}
 	doc.timeLock.Unlock()
 
 	if err != nil {
 		panic(err)
 	}
+	// the old JSON file, if any, is now out of date
+	os.Remove(ppd.jsonPathForDoc(doc))
 
 	return nil
 }
@@ -121,16 +196,111 @@ func (ppd *PadPersistenceWorker) syncDoc(docName string, doc *Doc) error {
  * Ranges over the server's Docs and syncs their content to disk.
  */
 func (ppd *PadPersistenceWorker) syncAllDocs() {
+	ppd.ps.mu.Lock()
+	docs := make(map[string]*Doc, len(ppd.ps.docs))
 	for docName, doc := range ppd.ps.docs {
+		docs[docName] = doc
+	}
+	ppd.ps.mu.Unlock()
+	for docName, doc := range docs {
 		// TODO: need to manage the commits performed so far?
 		go ppd.syncDoc(docName, doc)
 	}
 }
 
+/*
+ * Removes the files of a deleted Doc. Any sync of the Doc in progress finishes
+ * first, and syncDoc skips deleted Docs, so the files are not written again.
+ */
+func (ppd *PadPersistenceWorker) removeDoc(doc *Doc) {
+	doc.timeLock.Lock()
+	defer doc.timeLock.Unlock()
+	os.Remove(ppd.pathForDoc(doc))
+	os.Remove(ppd.jsonPathForDoc(doc))
+	os.Remove(ppd.snapshotPathForDoc(doc))
+}
+
+/*
+ * Rewrites the metadata from scratch, with a line for each of the server's Docs
+ * which were created followed by one for each deleted doc and one for each alias.
+ * The caller must hold the server's lock.
+ */
+func (ppd *PadPersistenceWorker) writeMetadata() {
+	var buf bytes.Buffer
+	for _, doc := range ppd.ps.docs {
+		// IDs are only given while holding the server's lock
+		if doc.Id == 0 {
+			continue
+		}
+		b, _ := json.Marshal(doc)
+		buf.Write(b)
+		buf.WriteString("\n")
+	}
+	for name := range ppd.ps.tombstones {
+		b, _ := json.Marshal(&Doc{Name: name, Deleted: true})
+		buf.Write(b)
+		buf.WriteString("\n")
+	}
+	for name, alias := range ppd.ps.aliases {
+		b, _ := json.Marshal(&Doc{Name: name, AliasOf: alias.Target, Expires: alias.Expires})
+		buf.Write(b)
+		buf.WriteString("\n")
+	}
+	// write a new file and move it into place, so a crash never leaves the
+	// metadata half written
+	path := METADATA + ppd.ps.port + JSON
+	if err := ioutil.WriteFile(path+".tmp", buf.Bytes(), 0644); err != nil {
+		panic(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		panic(err)
+	}
+}
+
+/*
+ * Gives a Doc the Id another peer has for it, moving its files to match, and
+ * rewrites the metadata. Any sync of the Doc in progress finishes first. The
+ * caller must hold the server's lock.
+ */
+func (ppd *PadPersistenceWorker) moveDoc(doc *Doc, id int64) {
+	doc.timeLock.Lock()
+	defer doc.timeLock.Unlock()
+	from := []string{ppd.pathForDoc(doc), ppd.snapshotPathForDoc(doc), ppd.jsonPathForDoc(doc)}
+	doc.mu.Lock()
+	doc.Id = id
+	doc.mu.Unlock()
+	to := []string{ppd.pathForDoc(doc), ppd.snapshotPathForDoc(doc), ppd.jsonPathForDoc(doc)}
+	for i := range from {
+		os.Rename(from[i], to[i])
+	}
+	// a placeholder has no files yet, and loadDoc expects one
+	if ok, _ := exists(to[0]); !ok {
+		if ok, _ := exists(to[2]); !ok {
+			os.Create(to[0])
+		}
+	}
+	ppd.writeMetadata()
+}
+
 /*
  * Yields path to a Doc's PadPersistentData
  */
 func (ppd *PadPersistenceWorker) pathForDoc(doc *Doc) string {
+	return "./docs" + ppd.ps.port + "/" + strconv.FormatInt(doc.Id, 10) + DOCFILE
+}
+
+/*
+ * Yields path to a Doc's snapshots, next to its doc file
+ */
+func (ppd *PadPersistenceWorker) snapshotPathForDoc(doc *Doc) string {
+	return "./docs" + ppd.ps.port + "/" + strconv.FormatInt(doc.Id, 10) + SNAPSHOTFILE
+}
+
+/*
+ * Yields path a Doc's PadPersistentData was written to as JSON, before doc files
+ * became binary
+ */
+func (ppd *PadPersistenceWorker) jsonPathForDoc(doc *Doc) string {
 	return "./docs" + ppd.ps.port + "/" + strconv.FormatInt(doc.Id, 10) + JSON
 }
 
@@ -0,0 +1,223 @@
+package pad
+
+// renaming of docs. renaming a doc moves it, with its commits, tags and anyone
+// waiting for its next commit, to a new name on every peer. the old name is
+// left as an alias of the new one for a while, ALIASPERIOD unless
+// MakePadServer is given another period, so clients still using it are sent
+// to the doc: requests about it are answered as if about the new name, with a
+// "renamed-to" header giving that name, and /docs/<old name> redirects to the
+// new one. once the alias expires, the old name is free to be used again.
+// aliases are stored in the metadata file with a line for each, such as
+//
+//   {"Id":0,"Name":"/docs/draft","AliasOf":"/docs/final","Expires":1415000000000000000}
+//
+// /rename renames the doc given by the "doc-id" header to the name given by
+// "new-id", which must not have any commits yet, once every peer has.
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// how long the old name of a renamed doc stays an alias of the new one,
+	// unless MakePadServer is given another period
+	ALIASPERIOD = 7 * 24 * time.Hour
+)
+
+// a name a doc was renamed from, which refers to it until expires, in Unix
+// nanoseconds
+type Alias struct {
+	Target  string
+	Expires int64
+}
+
+// moves the doc docID to newName, leaving docID an alias of it until expires.
+// fails with a MalformedError if docID has no commits or newName is in use,
+// and a DeletedError if either was deleted.
+func (ps *PadServer) rename(docID, newName string, expires int64) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if newName == "" || newName == docID {
+		return &MalformedError{fmt.Sprintf("cannot rename %q to %q", docID, newName)}
+	} else if ps.tombstones[docID] {
+		return &DeletedError{docID}
+	} else if ps.tombstones[newName] {
+		return &DeletedError{newName}
+	}
+
+	// docs are created on each peer as soon as they are looked at, so only
+	// commits tell whether a doc is in use
+	doc, ok := ps.docs[docID]
+	if !ok {
+		return &MalformedError{fmt.Sprintf("%q has no commits", docID)}
+	}
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if doc.head() == 0 {
+		return &MalformedError{fmt.Sprintf("%q has no commits", docID)}
+	}
+	displaced, ok := ps.docs[newName]
+	if ok {
+		displaced.mu.Lock()
+		used := displaced.head() > 0
+		displaced.mu.Unlock()
+		if used {
+			return &MalformedError{fmt.Sprintf("%q already has commits", newName)}
+		}
+	}
+
+	delete(ps.docs, docID)
+	doc.Name = newName
+	ps.docs[newName] = doc
+	if displaced != nil {
+		// anyone already waiting for the first commit of the new name can
+		// have it now, or wait for the doc's next one if it was forked at
+		// its base and has none after it
+		displaced.mu.Lock()
+		if doc.head() > doc.base {
+			for _, c := range displaced.listeners {
+				c <- doc.commit(doc.base + 1)
+			}
+		} else {
+			doc.listeners = append(doc.listeners, displaced.listeners...)
+		}
+		displaced.listeners = nil
+		displaced.mu.Unlock()
+		ps.ppd.removeDoc(displaced)
+	}
+
+	// the new name is no longer an alias, and aliases of the old one now refer
+	// to the new one, so there are never chains of them
+	delete(ps.aliases, newName)
+	for name, alias := range ps.aliases {
+		if alias.Target == docID {
+			ps.aliases[name] = Alias{newName, alias.Expires}
+		}
+	}
+	if expires > 0 {
+		ps.aliases[docID] = Alias{newName, expires}
+	}
+	for _, fork := range ps.docs {
+		if fork != doc {
+			fork.mu.Lock()
+			if fork.origin == docID {
+				fork.origin = newName
+			}
+			fork.mu.Unlock()
+		}
+	}
+	ps.ppd.writeMetadata()
+	return nil
+}
+
+// returns the name of the doc name is an alias of as of now, in Unix
+// nanoseconds, if it is one. the caller must hold ps.mu.
+func (ps *PadServer) target(name string, now int64) (string, bool) {
+	if alias, ok := ps.aliases[name]; ok && alias.Expires > now {
+		return alias.Target, true
+	}
+	return name, false
+}
+
+// returns the name of the doc name refers to when an op proposed at now is
+// executed
+func (ps *PadServer) resolve(name string, now int64) string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	name, _ = ps.target(name, now)
+	return name
+}
+
+// forgets aliases which expired by now, in Unix nanoseconds
+func (ps *PadServer) expireAliases(now int64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	expired := false
+	for name, alias := range ps.aliases {
+		if alias.Expires <= now {
+			delete(ps.aliases, name)
+			expired = true
+		}
+	}
+	if expired {
+		ps.ppd.writeMetadata()
+	}
+}
+
+// returns every alias, by name
+func (ps *PadServer) allAliases() map[string]Alias {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	aliases := make(map[string]Alias, len(ps.aliases))
+	for name, alias := range ps.aliases {
+		aliases[name] = alias
+	}
+	return aliases
+}
+
+// adds aliases another peer has which have not expired by now, in Unix
+// nanoseconds. a doc this peer has under one of their names, without any
+// commits, is only a placeholder, and is replaced by the alias. a doc with
+// commits is never replaced: the peer may have been down since long before
+// the name was used again.
+func (ps *PadServer) syncAliases(aliases map[string]Alias, now int64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	added := false
+	for name, alias := range aliases {
+		if alias.Expires <= now {
+			continue
+		} else if mine, ok := ps.aliases[name]; ok && mine.Expires >= alias.Expires {
+			continue
+		}
+		if doc, ok := ps.docs[name]; ok {
+			doc.mu.Lock()
+			used := doc.head() > 0
+			doc.mu.Unlock()
+			if used {
+				continue
+			}
+			delete(ps.docs, name)
+			ps.ppd.removeDoc(doc)
+		}
+		ps.aliases[name] = alias
+		added = true
+	}
+	if added {
+		ps.ppd.writeMetadata()
+	}
+}
+
+func (ps *PadServer) renameHandler(w http.ResponseWriter, r *http.Request) {
+	docID := r.Header.Get("doc-id")
+	newName := r.Header.Get("new-id")
+	if newName == "" || newName == docID {
+		http.Error(w, "new-id must name a new doc", http.StatusBadRequest)
+		return
+	}
+	if _, err := ps.proposeAndWait(makeOp(RENAME, RenameArgs{docID, newName, ps.aliasPeriod})); err != nil {
+		mergerError(w, err)
+		return
+	}
+	w.Header().Set("renamed-to", newName)
+}
+
+// redirects requests for the page of an alias to the page of the doc it
+// refers to
+func (ps *PadServer) redirect(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ps.mu.Lock()
+		target, ok := ps.target(r.URL.Path, time.Now().UnixNano())
+		ps.mu.Unlock()
+		if ok {
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+			return
+		}
+		handler(w, r)
+	}
+}
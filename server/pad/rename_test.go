@@ -0,0 +1,107 @@
+package pad
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenameAliasExpires(t *testing.T) {
+	ps := testServer(t)
+	edit(t, ps, "draft", "one")
+	now := time.Now().UnixNano()
+	rename := Op{RENAME, RenameArgs{"draft", "final", time.Hour}, nrand(), now}
+	if _, err := run(ps, rename); err != nil {
+		t.Fatal(err)
+	}
+	expectText(t, ps, "final", 1, "one")
+
+	// until the alias expires, ops about the old name are about the new one
+	edit(t, ps, "draft", "one two")
+	expectText(t, ps, "final", 2, "one two")
+	if _, ok := ps.docs["draft"]; ok {
+		t.Fatal("the old name is still a doc of its own")
+	}
+
+	// once it expires, the old name is free to be used again
+	later := now + int64(2*time.Hour)
+	if _, err := run(ps, Op{CREATE, CreateArgs{"draft", nrand()}, nrand(), later}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ps.aliases["draft"]; ok {
+		t.Fatal("the alias did not expire")
+	}
+	edit(t, ps, "draft", "new")
+	expectText(t, ps, "draft", 1, "new")
+	expectText(t, ps, "final", 2, "one two")
+
+	// a peer which was down all along still has the alias, but its sync must
+	// neither bring it back nor remove the new doc
+	sync := SyncArgs{map[string]*DocData{}, nil, map[string]Alias{"draft": {"final", now + int64(time.Hour)}}}
+	if _, err := run(ps, Op{SYNC, sync, nrand(), later}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ps.aliases["draft"]; ok {
+		t.Fatal("an expired alias was synced")
+	}
+	expectText(t, ps, "draft", 1, "new")
+}
+
+func TestSyncAliases(t *testing.T) {
+	ps := testServer(t)
+	edit(t, ps, "used", "one")
+	ps.getDoc("unused")
+	now := time.Now().UnixNano()
+	aliases := map[string]Alias{
+		"used":   {"final", now + int64(time.Hour)},
+		"unused": {"final", now + int64(time.Hour)},
+	}
+	if _, err := run(ps, Op{SYNC, SyncArgs{map[string]*DocData{}, nil, aliases}, nrand(), now}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a placeholder gives way to another peer's alias, a doc with commits never
+	if _, ok := ps.aliases["unused"]; !ok {
+		t.Fatal("an alias was not synced")
+	} else if _, ok := ps.docs["unused"]; ok {
+		t.Fatal("a placeholder was kept under the name of an alias")
+	}
+	if _, ok := ps.aliases["used"]; ok {
+		t.Fatal("an alias was synced over a doc with commits")
+	}
+	expectText(t, ps, "used", 1, "one")
+}
+
+// a fork taken at its source's base has no commit after it to hand anyone
+// waiting for the first commit of the name it is renamed to, so they wait on
+func TestRenameForkAtBase(t *testing.T) {
+	ps := testServer(t)
+	ps.retention = 2
+	for _, text := range []string{"a", "ab", "abc", "abcd", "abcde"} {
+		edit(t, ps, "draft", text)
+	}
+	if _, err := run(ps, makeOp(CREATE, CreateArgs{"copy", nrand()})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run(ps, makeOp(FORK, ForkArgs{"copy", "draft", 2})); err != nil {
+		t.Fatal(err)
+	}
+	if base, head := ps.getDoc("copy").getBounds(); base != 2 || head != 2 {
+		t.Fatalf("fork has commits %v to %v, not 2 to 2", base, head)
+	}
+
+	waiting := make(chan Commit, 1)
+	final := ps.getDoc("final")
+	final.listeners = append(final.listeners, waiting)
+	if _, err := run(ps, makeOp(RENAME, RenameArgs{"copy", "final", time.Hour})); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-waiting:
+		t.Fatalf("waiting for the first commit of final gave %v", c)
+	default:
+	}
+	edit(t, ps, "final", "abx")
+	if c := <-waiting; c.Parent != 2 {
+		t.Fatalf("waiting for the first commit of final gave %v", c)
+	}
+}
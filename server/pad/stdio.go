@@ -0,0 +1,262 @@
+package pad
+
+// defines a StdioMerger, which runs the javascript merge logic in a long-lived
+// node child process, git-rpc.js, and talks to it over the child's stdin and
+// stdout rather than localhost HTTP. requests and responses are newline
+// delimited JSON-RPC 2.0 messages tagged with ids, so any number of calls can
+// be in flight at once and responses may come back in any order. the child is
+// relaunched whenever it exits.
+
+import (
+	"../git"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// JSON-RPC 2.0 error code for params the method could not make sense of
+const rpcInvalidParams = -32602
+
+type rpcRequest struct {
+	Version string      `json:"jsonrpc"`
+	ID      int64       `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+var errNotRunning = errors.New("node helper is not running")
+
+type StdioMerger struct {
+	mu      sync.Mutex
+	script  string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser // nil while the child is not running
+	nextID  int64
+	pending map[int64]chan rpcResponse // calls awaiting a response, by id
+	healthy bool
+	dead    bool
+}
+
+// script is the path to git-rpc.js.
+func MakeStdioMerger(script string) *StdioMerger {
+	sm := &StdioMerger{}
+	sm.script = script
+	sm.pending = make(map[int64]chan rpcResponse)
+	return sm
+}
+
+func (sm *StdioMerger) GetDiff(a, b string) (git.Diff, error) {
+	diff := git.Diff{}
+	text, err := sm.call("getDiff", map[string]interface{}{
+		"a": json.RawMessage(a),
+		"b": json.RawMessage(b),
+	})
+	if err == nil {
+		err = answer(text, &diff)
+	}
+	return diff, err
+}
+
+func (sm *StdioMerger) Rebase(c1, c2 Commit) (Commit, error) {
+	if err := requireUTF16(c1, c2); err != nil {
+		return Commit{}, err
+	}
+	rebased := Commit{}
+	text, err := sm.call("rebase", map[string]interface{}{"c1": c1, "c2": c2})
+	if err == nil {
+		err = answer(text, &rebased)
+	}
+	return rebased, err
+}
+
+// the javascript only counts UTF-16 code units, so commits are converted first
+func (sm *StdioMerger) ApplyDiff(text string, commit Commit) (string, error) {
+	commit, err := ConvertCommit(text, commit, git.UTF16)
+	if err != nil {
+		return "", err
+	}
+	return sm.call("applyDiff", map[string]interface{}{
+		"text":   json.RawMessage(text),
+		"commit": commit,
+	})
+}
+
+// launches the child process, relaunching it whenever it exits
+func (sm *StdioMerger) Start() error {
+	return sm.launch()
+}
+
+func (sm *StdioMerger) Healthy() bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.healthy
+}
+
+// stops relaunching and kills the child process
+func (sm *StdioMerger) Kill() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.dead = true
+	sm.healthy = false
+	if sm.cmd != nil {
+		sm.cmd.Process.Kill()
+	}
+}
+
+// sends a request and waits up to NODETIMEOUT for its response, which is
+// returned JSON-ified
+func (sm *StdioMerger) call(method string, params interface{}) (string, error) {
+	sm.mu.Lock()
+	if sm.stdin == nil {
+		sm.mu.Unlock()
+		return "", errNotRunning
+	}
+	sm.nextID += 1
+	id := sm.nextID
+	line, err := json.Marshal(rpcRequest{"2.0", id, method, params})
+	if err != nil {
+		// one of the params was not valid JSON to begin with
+		sm.mu.Unlock()
+		return "", &MalformedError{err.Error()}
+	}
+	ch := make(chan rpcResponse, 1)
+	sm.pending[id] = ch
+	_, err = sm.stdin.Write(append(line, '\n'))
+	sm.mu.Unlock()
+	if err != nil {
+		sm.forget(id)
+		return "", err
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return "", fmt.Errorf("node helper exited during %v", method)
+		}
+		if res.Error != nil && res.Error.Code == rpcInvalidParams {
+			return "", &MalformedError{res.Error.Message}
+		} else if res.Error != nil {
+			return "", fmt.Errorf("node helper %v: %v", method, res.Error.Message)
+		}
+		return string(res.Result), nil
+	case <-time.After(NODETIMEOUT):
+		sm.forget(id)
+		return "", fmt.Errorf("node helper %v: timed out", method)
+	}
+}
+
+func (sm *StdioMerger) forget(id int64) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	delete(sm.pending, id)
+}
+
+// starts the child process along with a goroutine reading its responses. it
+// is not healthy until it first answers a ping.
+func (sm *StdioMerger) launch() error {
+	cmd := exec.Command("node", sm.script)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	sm.mu.Lock()
+	sm.cmd = cmd
+	sm.stdin = stdin
+	sm.healthy = false
+	sm.mu.Unlock()
+
+	go sm.read(cmd, bufio.NewReader(stdout))
+	go func() {
+		for {
+			_, err := sm.call("ping", nil)
+			sm.mu.Lock()
+			current := sm.cmd == cmd && sm.stdin != nil
+			sm.healthy = current && err == nil
+			sm.mu.Unlock()
+			if err == nil || !current {
+				return
+			}
+			time.Sleep(HEALTHINTERVAL)
+		}
+	}()
+	return nil
+}
+
+// hands each response to the call waiting on it until the child exits, then
+// fails every call still waiting and relaunches the child
+func (sm *StdioMerger) read(cmd *exec.Cmd, stdout *bufio.Reader) {
+	for {
+		line, err := stdout.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		res := rpcResponse{}
+		if err := json.Unmarshal(line, &res); err != nil {
+			fmt.Println("node helper sent an unreadable response:", err)
+			continue
+		}
+		sm.mu.Lock()
+		if ch, ok := sm.pending[res.ID]; ok {
+			delete(sm.pending, res.ID)
+			ch <- res
+		}
+		sm.mu.Unlock()
+	}
+	cmd.Wait()
+
+	sm.mu.Lock()
+	sm.stdin.Close()
+	sm.stdin = nil
+	sm.healthy = false
+	for id, ch := range sm.pending {
+		delete(sm.pending, id)
+		close(ch)
+	}
+	dead := sm.dead
+	sm.mu.Unlock()
+	if dead {
+		return
+	}
+
+	fmt.Println("node helper exited, relaunching:", cmd.ProcessState)
+	for {
+		time.Sleep(RELAUNCHDELAY)
+		sm.mu.Lock()
+		dead := sm.dead
+		sm.mu.Unlock()
+		if dead {
+			return
+		}
+		err := sm.launch()
+		if err == nil {
+			return
+		}
+		fmt.Println("node helper could not be launched:", err)
+	}
+}
@@ -0,0 +1,114 @@
+package pad
+
+// names for commits of a doc, such as "v1-approved" or "sent-to-legal", so a
+// version can be found again without remembering its index. like commits,
+// tags are added through paxos so every peer has the same ones, and are
+// stored in the doc's file.
+//
+// /tags/put tags the commit given by the "at-commit" header, head if absent,
+// of the doc given by "doc-id" with the name given by "tag". a name can only
+// be used once per doc. /tags replies with a doc's tags as JSON, in order of
+// commit, e.g.
+//
+//   [{"name":"draft","commit":4},{"name":"v1-approved","commit":12}]
+//
+// and /init replies with the text of a doc as of the tag given by an "at-tag"
+// header.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+type Tag struct {
+	Name   string `json:"name"`
+	Commit int    `json:"commit"`
+}
+
+// orders tags by commit, and by name for tags of the same commit
+type byCommit []Tag
+
+func (t byCommit) Len() int      { return len(t) }
+func (t byCommit) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t byCommit) Less(i, j int) bool {
+	if t[i].Commit != t[j].Commit {
+		return t[i].Commit < t[j].Commit
+	}
+	return t[i].Name < t[j].Name
+}
+
+func sortedTags(tags map[string]int) []Tag {
+	sorted := make([]Tag, 0, len(tags))
+	for name, commit := range tags {
+		sorted = append(sorted, Tag{name, commit})
+	}
+	sort.Sort(byCommit(sorted))
+	return sorted
+}
+
+// names commit of the doc. fails with a MalformedError if the doc was not
+// created, the name is empty or taken, or the doc has no such commit, and a
+// DeletedError if it was deleted.
+func (doc *Doc) tag(name string, commit int) error {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	if doc.Deleted {
+		return &DeletedError{doc.Name}
+	} else if err := doc.created(); err != nil {
+		return err
+	} else if name == "" {
+		return &MalformedError{"tags must have a name"}
+	} else if _, ok := doc.tags[name]; ok {
+		return &MalformedError{fmt.Sprintf("tag %q already names commit %v", name, doc.tags[name])}
+	} else if commit < 0 || commit > doc.head() {
+		return &MalformedError{fmt.Sprintf("commit %v is not between 0 and head %v", commit, doc.head())}
+	}
+	// the persistence worker reads tags without holding doc.mu, so they are
+	// copied rather than changed in place
+	tags := make(map[string]int, len(doc.tags)+1)
+	for n, c := range doc.tags {
+		tags[n] = c
+	}
+	tags[name] = commit
+	doc.tags = tags
+	return nil
+}
+
+// returns the commit the tag names, if the doc has such a tag
+func (doc *Doc) getTag(name string) (int, bool) {
+	doc.mu.Lock()
+	defer doc.mu.Unlock()
+	commit, ok := doc.tags[name]
+	return commit, ok
+}
+
+func (ps *PadServer) tagPutter(w http.ResponseWriter, r *http.Request) {
+	docID := r.Header.Get("doc-id")
+	_, commit := ps.getDoc(docID).getBounds()
+	if h := r.Header.Get("at-commit"); h != "" {
+		var err error
+		if commit, err = strconv.Atoi(h); err != nil {
+			http.Error(w, fmt.Sprintf("invalid commit %q", h), http.StatusBadRequest)
+			return
+		}
+	}
+	args := TagArgs{docID, r.Header.Get("tag"), commit}
+	if _, err := ps.proposeAndWait(makeOp(TAG, args)); err != nil {
+		mergerError(w, err)
+		return
+	}
+	w.Header().Add("head", strconv.Itoa(commit))
+}
+
+func (ps *PadServer) tagsHandler(w http.ResponseWriter, r *http.Request) {
+	doc := ps.getDoc(r.Header.Get("doc-id"))
+	doc.mu.Lock()
+	tags := sortedTags(doc.tags)
+	doc.mu.Unlock()
+	b, _ := json.Marshal(tags)
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,49 @@
+package pad
+
+import (
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	ps := testServer(t)
+	edit(t, ps, "draft", "one")
+	edit(t, ps, "draft", "one two")
+	tag := func(docID, name string, commit int) error {
+		_, err := run(ps, makeOp(TAG, TagArgs{docID, name, commit}))
+		return err
+	}
+	if err := tag("draft", "v1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tag("draft", "latest", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// names are never reused, and only name commits the doc has
+	if err := tag("draft", "v1", 2); err == nil {
+		t.Fatal("tagged two commits with the same name")
+	}
+	if err := tag("draft", "future", 3); err == nil {
+		t.Fatal("tagged a commit past head")
+	}
+	if err := tag("nowhere", "v1", 0); err == nil {
+		t.Fatal("tagged a doc which does not exist")
+	} else if _, ok := err.(*MalformedError); !ok {
+		t.Fatalf("tagging a doc which does not exist failed with %v", err)
+	}
+	if _, ok := ps.docs["nowhere"]; ok {
+		t.Fatal("tagging a doc which does not exist made a placeholder for it")
+	}
+
+	// tags are kept with the doc on disk
+	doc := ps.getDoc("draft")
+	if err := ps.ppd.syncDoc("draft", doc); err != nil {
+		t.Fatal(err)
+	}
+	restarted := testPeer(t, ps.port)
+	for name, want := range map[string]int{"v1": 1, "latest": 2} {
+		if commit, ok := restarted.getDoc("draft").getTag(name); !ok || commit != want {
+			t.Fatalf("after restarting, %q names commit %v, %v, not %v", name, commit, ok, want)
+		}
+	}
+}
@@ -7,24 +7,71 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // entry point for starting a single pad server. it expects the first argument
 // to be a configuration file with each line as the IP:port of each of its
-// peers. the second argument is its index in that list.
+// peers. the second argument is its index in that list. an optional third
+// argument, "node", rebases using git-server.js instead of the native Go
+// merger, launching and supervising it as a child process. "node-rpc" runs the
+// same Javascript in a child process, git-rpc.js, spoken to over its stdin and
+// stdout. "node-external" instead uses a git-server.js which is already
+// running. an optional fourth argument sets how many commits apart snapshots
+// of each document are taken, so older versions can be rebuilt quickly, and an
+// optional fifth how many commits each document keeps before compacting older
+// ones. every peer must be given the same retention. an optional sixth, such
+// as "72h", sets how long the old name of a renamed document keeps leading to
+// it.
 //
 // Note: the port in the file is the port which paxos communicates over.  the
-// port + 1000 is the port the webpages are being served on and the port - 1000
-// is the port the local node server is listening on.
+// port + 1000 is the port the webpages are being served on and, when using
+// "node-external", the port - 1000 is the port the node server is listening on.
 func main() {
-	if len(os.Args) != 3 {
+	if len(os.Args) < 3 || len(os.Args) > 7 {
 		fmt.Println("Incorrect number of arguments.")
 	} else {
 		me, _ := strconv.Atoi(os.Args[2])
 		fname := os.Args[1]
 		if data, err := ioutil.ReadFile(fname); err == nil {
 			peers := strings.Split(strings.TrimSpace(string(data)), "\n")
-			server := pad.MakePadServer(peers, me)
+			var merger pad.Merger = pad.MakeNativeMerger()
+			if len(os.Args) >= 4 && os.Args[3] == "node" {
+				merger = pad.MakeNodeHelper("git-server.js")
+			} else if len(os.Args) >= 4 && os.Args[3] == "node-rpc" {
+				merger = pad.MakeStdioMerger("git-rpc.js")
+			} else if len(os.Args) >= 4 && os.Args[3] == "node-external" {
+				rpcPort, _ := strconv.Atoi(strings.Split(peers[me], ":")[1])
+				merger = pad.MakeNodeMerger(strconv.Itoa(rpcPort - 1000))
+			} else if len(os.Args) >= 4 && os.Args[3] != "native" {
+				fmt.Println("Unknown merger", os.Args[3])
+				return
+			}
+			interval := pad.SNAPSHOTINTERVAL
+			if len(os.Args) >= 5 {
+				interval, err = strconv.Atoi(os.Args[4])
+				if err != nil || interval < 0 {
+					fmt.Println("Invalid snapshot interval", os.Args[4])
+					return
+				}
+			}
+			retention := pad.RETENTION
+			if len(os.Args) >= 6 {
+				retention, err = strconv.Atoi(os.Args[5])
+				if err != nil || retention < 0 {
+					fmt.Println("Invalid retention", os.Args[5])
+					return
+				}
+			}
+			period := pad.ALIASPERIOD
+			if len(os.Args) == 7 {
+				period, err = time.ParseDuration(os.Args[6])
+				if err != nil || period < 0 {
+					fmt.Println("Invalid alias period", os.Args[6])
+					return
+				}
+			}
+			server := pad.MakePadServer(peers, me, merger, interval, retention, period)
 			server.Start()
 		} else {
 			fmt.Println("Error reading config file", err)
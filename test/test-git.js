@@ -175,5 +175,57 @@ var testRebase = function() {
 
 }
 
+var testUnicode = function() {
+
+  console.log("********** testUnicode **********")
+
+  // indexes count UTF-16 code units, so an astral plane character is two
+  assert.deepEqual(git.getDiff("a\ud83d\ude00b", "ab"), [{type: "Delete", index: 1, size: 2}]);
+  assert.deepEqual(git.getDiff("\ud83d\ude00", "a\ud83d\ude00"), [{type: "Insert", index: 0, val: "a"}]);
+
+  // a combining mark is a character of its own
+  assert.deepEqual(git.getDiff("e\u0301", "e"), [{type: "Delete", index: 1, size: 1}]);
+
+  var texts = ["\ud83d\ude00", "a\ud83d\ude00b", "e\u0301", "\ud83d\udc4d\ud83c\udffd",
+               "\u4e2d\u6587\ud83d\ude00", "\ud83c\uddeb\ud83c\uddf7", ""];
+  for (var i = 0; i < texts.length; i += 1) {
+    for (var j = 0; j < texts.length; j += 1) {
+      var diff = git.getDiff(texts[i], texts[j]);
+      assert.equal(git.applyDiff(texts[i], diff), texts[j]);
+    }
+  }
+  console.log("getDiff and applyDiff round trips passed");
+
+  var runRebase = function(original, a, b) {
+    var d1 = git.getDiff(original, a);
+    var d2 = git.getDiff(original, b);
+    return git.applyDiff(git.applyDiff(original, d1), git.rebase(d1, d2));
+  }
+  assert.equal(runRebase("a\ud83d\ude00b", "ab", "a\ud83d\ude00\ud83d\ude03b"), "a\ud83d\ude03b");
+  assert.equal(runRebase("e\u0301x", "ex", "e\u0301\u0302x"), "e\u0302x");
+  assert.equal(runRebase("\u4e2d\u6587\ud83d\ude00", "\u4e2d\ud83d\ude00", "\u4e2d\u6587\u5b57\ud83d\ude00"), "\u4e2d\u5b57\ud83d\ude00");
+  assert.equal(runRebase("\ud83d\udc4d\ud83c\udffd", "\ud83d\udc4d", "\ud83d\udc4d\ud83c\udffd!"), "\ud83d\udc4d!");
+  console.log("rebase tests passed");
+
+  // astral plane characters which share their first code unit, like these
+  // two, are diffed a code unit at a time, so the diff only replaces the
+  // second half of the pair. the server realigns such diffs to whole
+  // characters before storing them, which must have the same effect.
+  var split = git.getDiff("\ud83d\ude00", "\ud83d\ude03");
+  assert.deepEqual(split, [{type: "Delete", index: 1, size: 1}, {type: "Insert", index: 2, val: "\ude03"}]);
+  assert.equal(git.applyDiff("\ud83d\ude00", split), "\ud83d\ude03");
+  assert.deepEqual(JSON.parse(JSON.stringify(split)), split);
+  var realigned = [{type: "Delete", index: 0, size: 2}, {type: "Insert", index: 2, val: "\ud83d\ude03"}];
+  assert.equal(git.applyDiff("\ud83d\ude00", realigned), "\ud83d\ude03");
+  var concurrent = git.getDiff("\ud83d\ude00", "\ud83d\ude00!");
+  assert.equal(git.applyDiff("\ud83d\ude03", git.rebase(realigned, concurrent)), "\ud83d\ude03!");
+  assert.equal(git.applyDiff("\ud83d\ude03", git.rebase(split, concurrent)), "\ud83d\ude03!");
+  console.log("split surrogate pair tests passed");
+
+  console.log("All unicode tests passed. ")
+
+}
+
 testGetAndApplyDiff();
 testRebase();
+testUnicode();